@@ -0,0 +1,442 @@
+package gocode
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"encoding/json"
+	"fmt"
+	"github.com/daviddengcn/go-villa"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Security advisories are imported from OSV-format JSON files, one advisory a
+// file, under advisoriesDir. An advisory is saved in kindAdvisory by its id
+// with the affected module or package paths indexed, and affects the packages
+// at or under those paths. The versions of packages are not crawled, so only
+// the advisories not fixed in the latest version are copied to
+// DocInfo.Advisories and badged, and the fixed ones to DocInfo.FixedAdvisories
+// as the package is processed. The affected packages are queued in
+// kindToUpdate on imports, which go in batches of files.
+const (
+	advisoriesDir = "advisories"
+	// the time to import advisories in a request
+	advisoryImportTTL = 30 * time.Second
+	// the maximum number of packages updated under an affected path
+	maxAdvisoryPackages = 1000
+	// the maximum number of dependents listed on an advisory page
+	maxAdvisoryDependents = 1000
+	// the maximum number of levels of dependents walked from affected packages
+	maxDependentDepth = 3
+)
+
+// osvEntry is the part of the OSV schema read, see https://ossf.github.io/osv-schema/.
+type osvEntry struct {
+	ID        string     `json:"id"`
+	Summary   string     `json:"summary"`
+	Details   string     `json:"details"`
+	Aliases   []string   `json:"aliases"`
+	Published time.Time  `json:"published"`
+	Modified  time.Time  `json:"modified"`
+	Withdrawn *time.Time `json:"withdrawn"`
+	Affected  []struct {
+		Package struct {
+			Ecosystem string `json:"ecosystem"`
+			Name      string `json:"name"`
+		} `json:"package"`
+		Ranges []struct {
+			Type   string `json:"type"`
+			Events []osvEvent `json:"events"`
+		} `json:"ranges"`
+		EcosystemSpecific struct {
+			Imports []struct {
+				Path string `json:"path"`
+			} `json:"imports"`
+		} `json:"ecosystem_specific"`
+	} `json:"affected"`
+	References []struct {
+		Type string `json:"type"`
+		URL  string `json:"url"`
+	} `json:"references"`
+}
+
+type osvEvent struct {
+	Introduced   string `json:"introduced"`
+	Fixed        string `json:"fixed"`
+	LastAffected string `json:"last_affected"`
+}
+
+// Advisory is a security advisory saved in kindAdvisory.
+type Advisory struct {
+	Summary   string    `datastore:",noindex"`
+	Details   string    `datastore:",noindex"`
+	Aliases   []string  `datastore:",noindex"`
+	URL       string    `datastore:",noindex"`
+	Published time.Time `datastore:",noindex"`
+	Modified  time.Time `datastore:",noindex"`
+	// the affected module or package paths
+	Paths []string
+	// the affected versions of the paths, e.g. "example.com/m: >= 0, < 1.2.3"
+	Ranges []string `datastore:",noindex"`
+	// true if a range is not fixed, i.e. the latest version is affected
+	Unfixed bool `datastore:",noindex"`
+	// the versions fixing the ranges
+	Fixed []string `datastore:",noindex"`
+}
+
+// formatOSVRange returns the versions of events as ">= a, < b" intervals, the
+// fixed versions, and whether the last interval is open.
+func formatOSVRange(events []osvEvent) (vers string, fixed []string, open bool) {
+	var intervals []string
+	for _, e := range events {
+		switch {
+		case e.Introduced != "":
+			intervals = append(intervals, ">= "+e.Introduced)
+			open = true
+		case open && e.Fixed != "":
+			intervals[len(intervals)-1] += ", < " + e.Fixed
+			fixed = append(fixed, e.Fixed)
+			open = false
+		case open && e.LastAffected != "":
+			intervals[len(intervals)-1] += ", <= " + e.LastAffected
+			open = false
+		}
+	}
+	return strings.Join(intervals, "; "), fixed, open
+}
+
+// advisoryOfOSV converts e, returning nil if it affects no Go package.
+func advisoryOfOSV(e *osvEntry) *Advisory {
+	a := &Advisory{
+		Summary:   e.Summary,
+		Details:   e.Details,
+		Aliases:   e.Aliases,
+		Published: e.Published,
+		Modified:  e.Modified,
+	}
+	paths := make(villa.StrSet)
+	for _, af := range e.Affected {
+		if af.Package.Ecosystem != "Go" || af.Package.Name == "" {
+			continue
+		}
+		// packages listed by the Go ecosystem are more precise than the module
+		var pkgs []string
+		for _, imp := range af.EcosystemSpecific.Imports {
+			pkgs = append(pkgs, imp.Path)
+		}
+		if len(pkgs) == 0 {
+			pkgs = []string{af.Package.Name}
+		}
+		paths.Put(pkgs...)
+		
+		for _, r := range af.Ranges {
+			vers, fixed, open := formatOSVRange(r.Events)
+			if vers == "" {
+				continue
+			}
+			a.Ranges = append(a.Ranges, af.Package.Name+": "+vers)
+			a.Fixed = append(a.Fixed, fixed...)
+			a.Unfixed = a.Unfixed || open
+		}
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+	a.Paths = paths.Elements()
+	sort.Strings(a.Paths)
+	
+	for _, typ := range []string{"ADVISORY", "WEB", ""} {
+		for _, ref := range e.References {
+			if a.URL == "" && (typ == "" || ref.Type == typ) {
+				a.URL = ref.URL
+			}
+		}
+	}
+	return a
+}
+
+// queueAffected queues in kindToUpdate the indexed packages at or under paths.
+func queueAffected(c appengine.Context, paths []string) {
+	pkgs := make(villa.StrSet)
+	for _, p := range paths {
+		docs, err := prefixDocs(c, p+"/", maxAdvisoryPackages)
+		if err != nil {
+			c.Errorf("prefixDocs(%s) failed: %v", p, err)
+		}
+		for _, d := range docs {
+			pkgs.Put(d.Package)
+		}
+		pkgs.Put(p)
+	}
+	ids := pkgs.Elements()
+	if len(ids) == 0 {
+		return
+	}
+	errs := NewDocDB(c, kindToUpdate).PutMulti(ids, make([]struct{}, len(ids)))
+	if errs.ErrorCount() > 0 {
+		c.Errorf("PutMulti(%d packages) to %s with %d failed: %v", len(ids),
+			kindToUpdate, errs.ErrorCount(), errs)
+	}
+}
+
+// importAdvisories imports the OSV files in dir, in the order of names, from
+// the from-th one for at most ttl, removing withdrawn advisories. It returns the
+// index of the file to continue from, 0 if done, and the number of advisories
+// saved.
+func importAdvisories(c appengine.Context, dir string, from int,
+		ttl time.Duration) (next, cnt int, err error) {
+	start := time.Now()
+	fns, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return 0, 0, err
+	}
+	
+	ddb := NewCachedDocDB(c, kindAdvisory)
+	for next = from; next < len(fns); next++ {
+		if next > from && time.Now().Sub(start) > ttl {
+			return next, cnt, nil
+		}
+		fn := fns[next]
+		data, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return next, cnt, err
+		}
+		var e osvEntry
+		if err := json.Unmarshal(data, &e); err != nil {
+			return next, cnt, fmt.Errorf("%s: %v", fn, err)
+		}
+		if e.ID == "" {
+			return next, cnt, fmt.Errorf("%s: no id", fn)
+		}
+		
+		// packages affected before the import are updated as well
+		var last Advisory
+		if err, _ := ddb.Get(e.ID, &last); err != nil {
+			c.Errorf("Get(%s, %s) failed: %v", kindAdvisory, e.ID, err)
+		}
+		a := advisoryOfOSV(&e)
+		if e.Withdrawn != nil || a == nil {
+			if err := ddb.Delete(e.ID); err != nil {
+				return next, cnt, err
+			}
+		} else {
+			if err := ddb.Put(e.ID, a); err != nil {
+				return next, cnt, err
+			}
+			cnt++
+			queueAffected(c, a.Paths)
+		}
+		queueAffected(c, last.Paths)
+	}
+	return 0, cnt, nil
+}
+
+// advisoriesOf returns the sorted ids of the unfixed and the fixed advisories
+// affecting pkg, i.e. of pkg or any of its ancestors.
+func advisoriesOf(c appengine.Context, pkg string) (unfixed, fixed []string) {
+	for p := pkg; strings.Contains(p, "/"); p = path.Dir(p) {
+		var ads []Advisory
+		keys, err := datastore.NewQuery(kindAdvisory).Filter("Paths=", p).
+			GetAll(c, &ads)
+		if err != nil {
+			c.Errorf("Query %s of %s failed: %v", kindAdvisory, p, err)
+			continue
+		}
+		for i, key := range keys {
+			if ads[i].Unfixed {
+				unfixed = append(unfixed, key.StringID())
+			} else {
+				fixed = append(fixed, key.StringID())
+			}
+		}
+	}
+	sort.Strings(unfixed)
+	sort.Strings(fixed)
+	return unfixed, fixed
+}
+
+// AdvisoryRef is an advisory listed on package pages.
+type AdvisoryRef struct {
+	ID      string
+	Summary string
+	Unfixed bool
+	// the versions fixing it, separated by commas
+	Fixed string
+}
+
+func advisoryRefOf(id string, a *Advisory) AdvisoryRef {
+	return AdvisoryRef{id, a.Summary, a.Unfixed, strings.Join(a.Fixed, ", ")}
+}
+
+func loadAdvisoryRefs(c appengine.Context, ids []string) []AdvisoryRef {
+	ddb := NewCachedDocDB(c, kindAdvisory)
+	refs := make([]AdvisoryRef, 0, len(ids))
+	for _, id := range ids {
+		var a Advisory
+		if err, _ := ddb.Get(id, &a); err != nil {
+			c.Errorf("Get(%s, %s) failed: %v", kindAdvisory, id, err)
+		}
+		refs = append(refs, advisoryRefOf(id, &a))
+	}
+	return refs
+}
+
+// AffectedImport is an imported package with advisories.
+type AffectedImport struct {
+	Package    string
+	Advisories []string
+}
+
+// affectedImports returns the packages in imports with advisories.
+func affectedImports(c appengine.Context, imports []string) []AffectedImport {
+	docs := make([]DocInfo, len(imports))
+	fetchDocs(c, imports, docs)
+	var res []AffectedImport
+	for _, d := range docs {
+		if len(d.Advisories) > 0 {
+			res = append(res, AffectedImport{d.Package, d.Advisories})
+		}
+	}
+	return res
+}
+
+// Dependent is a package importing an affected package, directly or not.
+type Dependent struct {
+	Package string
+	// the imported package through which Package is affected
+	Via   string
+	Depth int
+}
+
+// affectedDependents walks ImportedPkgs from the affected docs, level by level,
+// up to maxDependentDepth levels and maxAdvisoryDependents packages.
+func affectedDependents(c appengine.Context, affected []DocInfo) []Dependent {
+	seen := make(villa.StrSet)
+	for _, d := range affected {
+		seen.Put(d.Package)
+	}
+	
+	var res []Dependent
+	level := affected
+	for depth := 1; depth <= maxDependentDepth && len(level) > 0; depth++ {
+		var next []string
+		for _, d := range level {
+			for _, imp := range d.ImportedPkgs {
+				if seen.In(imp) || len(res) >= maxAdvisoryDependents {
+					continue
+				}
+				seen.Put(imp)
+				res = append(res, Dependent{imp, d.Package, depth})
+				next = append(next, imp)
+			}
+		}
+		level = make([]DocInfo, len(next))
+		fetchDocs(c, next, level)
+	}
+	return res
+}
+
+// AdvisoryPage is the content of /advisory.
+type AdvisoryPage struct {
+	ID string
+	Advisory
+	// the indexed packages affected
+	Packages   []string
+	Dependents []Dependent
+}
+
+// pageAdvisory shows the advisory ?id= with the affected packages and their
+// dependents.
+func pageAdvisory(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	id := strings.TrimSpace(r.FormValue("id"))
+	p := AdvisoryPage{ID: id}
+	err, exists := NewCachedDocDB(c, kindAdvisory).Get(id, &p.Advisory)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "No such advisory", http.StatusNotFound)
+		return
+	}
+	
+	var affected []DocInfo
+	for _, affectedPath := range p.Paths {
+		docs, err := prefixDocs(c, affectedPath+"/", maxAdvisoryPackages)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var d DocInfo
+		err, exists := NewCachedDocDB(c, kindDocDB).Get(affectedPath, &d)
+		if err != nil {
+			c.Errorf("Get(%s, %s) failed: %v", kindDocDB, affectedPath, err)
+		} else if exists {
+			docs = append([]DocInfo{d}, docs...)
+		}
+		affected = append(affected, docs...)
+	}
+	for _, d := range affected {
+		p.Packages = append(p.Packages, d.Package)
+	}
+	p.Dependents = affectedDependents(c, affected)
+	
+	if err := templates.ExecuteTemplate(w, "advisory.html", p); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// pageAdvisories lists the advisories, and imports the files in advisoriesDir
+// on POST, from the file of form value "from". Submit the continue form to
+// import the next batch.
+func pageAdvisories(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	var message string
+	next := 0
+	if r.Method == "POST" {
+		from, _ := strconv.Atoi(r.FormValue("from"))
+		var cnt int
+		var err error
+		next, cnt, err = importAdvisories(c, advisoriesDir, from,
+			advisoryImportTTL)
+		message = fmt.Sprintf("%d advisories imported", cnt)
+		if err != nil {
+			message += ", failed: " + err.Error()
+		} else if next > 0 {
+			message += fmt.Sprintf(", continue from file %d", next)
+		}
+	}
+	
+	var ads []Advisory
+	keys, err := datastore.NewQuery(kindAdvisory).GetAll(c, &ads)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	refs := make([]AdvisoryRef, len(keys))
+	for i, key := range keys {
+		refs[i] = advisoryRefOf(key.StringID(), &ads[i])
+	}
+	
+	err = templates.ExecuteTemplate(w, "advisories.html", struct {
+		Dir        string
+		Message    string
+		Next       int
+		Advisories []AdvisoryRef
+	}{
+		Dir:        advisoriesDir,
+		Message:    message,
+		Next:       next,
+		Advisories: refs,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
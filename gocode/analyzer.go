@@ -0,0 +1,260 @@
+package gocode
+
+import (
+	"github.com/daviddengcn/go-index"
+	"github.com/daviddengcn/go-villa"
+	"regexp"
+	"strings"
+)
+
+// CharFilter transforms the text before tokenizing.
+type CharFilter func(text string) string
+
+// TokenFilter transforms a stream of tokens. It may change, remove or add
+// tokens.
+type TokenFilter func(tokens []string) []string
+
+// Analyzer converts text into the terms of the index. The same analyzer of a
+// field is used for indexing, querying and highlighting.
+type Analyzer interface {
+	// Analyze returns the terms of text in order, duplicates are possible.
+	Analyze(text string) []string
+	// Tokenizer returns the rune-type function splitting the raw text into
+	// tokens, used for highlighting.
+	Tokenizer() func(last, current rune) index.RuneType
+	// TokenTerms returns the terms of a single token from Tokenizer.
+	TokenTerms(token string) []string
+	// MarkToken splits a token from Tokenizer into segments, and calls output
+	// with each segment and whether it matches any term in tokens.
+	MarkToken(token string, tokens villa.StrSet,
+		output func(segment string, marked bool))
+}
+
+// Pipeline is an Analyzer applying char filters, a tokenizer and token filters
+// in order.
+type Pipeline struct {
+	CharFilters  []CharFilter
+	Split        func(last, current rune) index.RuneType
+	TokenFilters []TokenFilter
+}
+
+func (p *Pipeline) filterTokens(tokens []string) []string {
+	for _, f := range p.TokenFilters {
+		tokens = f(tokens)
+	}
+	return tokens
+}
+
+func (p *Pipeline) Analyze(text string) []string {
+	for _, f := range p.CharFilters {
+		text = f(text)
+	}
+	
+	var tokens []string
+	index.Tokenize(p.Split, villa.NewPByteSlice([]byte(text)), func(token []byte) error {
+		tokens = append(tokens, string(token))
+		return nil
+	})
+	
+	return p.filterTokens(tokens)
+}
+
+func (p *Pipeline) Tokenizer() func(last, current rune) index.RuneType {
+	return p.Split
+}
+
+func (p *Pipeline) TokenTerms(token string) []string {
+	return p.filterTokens([]string{token})
+}
+
+func (p *Pipeline) MarkToken(token string, tokens villa.StrSet,
+		output func(segment string, marked bool)) {
+	var matched []string
+	for _, term := range p.TokenTerms(token) {
+		if tokens.In(term) {
+			matched = append(matched, term)
+		}
+	}
+	if len(matched) == 0 {
+		output(token, false)
+		return
+	}
+	
+	lower := strings.ToLower(token)
+	if len(lower) != len(token) {
+		output(token, true)
+		return
+	}
+	
+	// mark the occurrences of the matched terms, e.g. the words of an
+	// identifier or the n-grams of a CJK run
+	marks := make([]bool, len(token))
+	found := false
+	for _, term := range matched {
+		if term == normWord(token) {
+			// the token itself matched
+			output(token, true)
+			return
+		}
+		for start := 0; start < len(lower); {
+			i := strings.Index(lower[start:], term)
+			if i < 0 {
+				break
+			}
+			start += i
+			for j := start; j < start+len(term); j++ {
+				marks[j] = true
+			}
+			start += len(term)
+			found = true
+		}
+	}
+	if !found {
+		// terms changed by stemming
+		output(token, true)
+		return
+	}
+	
+	for i := 0; i < len(token); {
+		j := i + 1
+		for j < len(token) && marks[j] == marks[i] {
+			j++
+		}
+		output(token[i:j], marks[i])
+		i = j
+	}
+}
+
+// analyzeTokens appends the terms of text analyzed by a to tokens.
+func analyzeTokens(a Analyzer, tokens villa.StrSet, text string) villa.StrSet {
+	for _, term := range a.Analyze(text) {
+		tokens.Put(term)
+	}
+	return tokens
+}
+
+// identFilter splits identifiers and path elements, e.g. HTTPServer, yaml.v2,
+// go-yaml or snake_case, into words. The token is kept as the compound, and
+// followed by its words and the compounds of adjacent words joined by "-".
+// Words joined by '-' or '_' are also concatenated, e.g. goyaml for go-yaml.
+func identFilter(tokens []string) []string {
+	res := make([]string, 0, len(tokens))
+	for _, token := range tokens {
+		token = strings.TrimFunc(token, isIdentPunct)
+		if token == "" {
+			continue
+		}
+		res = append(res, token)
+		
+		words := splitIdent(token)
+		if len(words) < 2 {
+			continue
+		}
+		last := ""
+		for _, word := range words {
+			res = append(res, word)
+			if last != "" {
+				res = append(res, last+"-"+word)
+			}
+			last = word
+		}
+		if strings.ContainsAny(token, "-_") {
+			res = append(res, strings.Join(words, ""))
+		}
+	}
+	return res
+}
+
+// normFilter lower-cases and stems tokens.
+func normFilter(tokens []string) []string {
+	for i, token := range tokens {
+		tokens[i] = normWord(token)
+	}
+	return tokens
+}
+
+// stopWordsFilter removes stop words, it should follow normFilter.
+func stopWordsFilter(tokens []string) []string {
+	res := tokens[:0]
+	for _, token := range tokens {
+		if !stopWords.In(token) {
+			res = append(res, token)
+		}
+	}
+	return res
+}
+
+// the maximum length of n-grams of CJK runes
+var CJKNGramSize = 2
+
+// isCJKToken returns true if token is a run of CJK runes.
+func isCJKToken(token string) bool {
+	if len(token) == 0 {
+		return false
+	}
+	for _, r := range token {
+		if !isCJK(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// cjkNGramFilter replaces a run of CJK runes with its single runes followed by
+// its n-grams of 2 to CJKNGramSize runes.
+func cjkNGramFilter(tokens []string) []string {
+	res := make([]string, 0, len(tokens))
+	for _, token := range tokens {
+		if !isCJKToken(token) {
+			res = append(res, token)
+			continue
+		}
+		
+		runes := []rune(token)
+		for n := 1; n <= CJKNGramSize && n <= len(runes); n++ {
+			for i := 0; i+n <= len(runes); i++ {
+				res = append(res, string(runes[i:i+n]))
+			}
+		}
+	}
+	return res
+}
+
+var patMarkup = regexp.MustCompile(`<[^<>]*>|!?\[([^\]]*)\]\([^)]*\)`)
+
+// filterMarkup removes HTML tags and the targets of Markdown links and
+// images, keeping the link texts.
+func filterMarkup(text string) string {
+	return patMarkup.ReplaceAllString(text, " $1 ")
+}
+
+// analyzers of fields
+var (
+	// for Name and Author
+	nameAnalyzer Analyzer = &Pipeline{
+		Split:        CheckIdentRuneType,
+		TokenFilters: []TokenFilter{identFilter, normFilter, cjkNGramFilter},
+	}
+	// for Package, path elements are tokens
+	packageAnalyzer Analyzer = &Pipeline{
+		Split:        CheckPathRuneType,
+		TokenFilters: []TokenFilter{identFilter, normFilter, cjkNGramFilter},
+	}
+	// for Synopsis and Description, words are not split further
+	textAnalyzer Analyzer = &Pipeline{
+		CharFilters: []CharFilter{filterURLs},
+		Split:       CheckRuneType,
+		TokenFilters: []TokenFilter{normFilter, stopWordsFilter,
+			cjkNGramFilter},
+	}
+	// for ReadmeData
+	readmeAnalyzer Analyzer = &Pipeline{
+		CharFilters: []CharFilter{filterMarkup, filterURLs},
+		Split:       CheckRuneType,
+		TokenFilters: []TokenFilter{normFilter, stopWordsFilter,
+			cjkNGramFilter},
+	}
+	// for queries, the terms have to be comparable with those of all fields.
+	// Compounds like yaml.v2 are split so that they match text fields too.
+	queryAnalyzer = textAnalyzer
+)
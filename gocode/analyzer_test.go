@@ -0,0 +1,110 @@
+package gocode
+
+import (
+	"github.com/daviddengcn/go-index"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitCamel(t *testing.T) {
+	for _, c := range []struct {
+		word  string
+		words []string
+	}{
+		{"http", []string{"http"}},
+		{"HTTPServer", []string{"HTTP", "Server"}},
+		{"HTTPServer2Go", []string{"HTTP", "Server2", "Go"}},
+		{"parseURL", []string{"parse", "URL"}},
+		{"URLs", []string{"URLs"}},
+		{"ReadURLs", []string{"Read", "URLs"}},
+		{"JSONDecoder", []string{"JSON", "Decoder"}},
+		{"GOPATH", []string{"GOPATH"}},
+	} {
+		if words := splitCamel(c.word); !reflect.DeepEqual(words, c.words) {
+			t.Errorf("splitCamel(%q) = %q, want %q", c.word, words, c.words)
+		}
+	}
+}
+
+// tokenize returns the raw tokens of text split by split.
+func tokenize(split func(last, current rune) index.RuneType,
+		text string) []string {
+	var tokens []string
+	index.Tokenize(split, strings.NewReader(text), func(token []byte) error {
+		tokens = append(tokens, string(token))
+		return nil
+	})
+	return tokens
+}
+
+func TestCheckIdentRuneType(t *testing.T) {
+	for _, c := range []struct {
+		text   string
+		tokens []string
+	}{
+		{"HTTPServer", []string{"HTTPServer"}},
+		{"yaml.v2", []string{"yaml.v2"}},
+		{"go-yaml snake_case", []string{"go-yaml", "snake_case"}},
+		{"a/b.c", []string{"a", "b.c"}},
+		{"(Reader)", []string{"Reader"}},
+		{"café", []string{"café"}},
+		{"Go语言", []string{"Go", "语言"}},
+	} {
+		if tokens := tokenize(CheckIdentRuneType, c.text); !reflect.DeepEqual(
+				tokens, c.tokens) {
+			t.Errorf("CheckIdentRuneType tokens of %q = %q, want %q", c.text,
+				tokens, c.tokens)
+		}
+	}
+}
+
+func TestCheckPathRuneType(t *testing.T) {
+	for _, c := range []struct {
+		text   string
+		tokens []string
+	}{
+		{"gopkg.in/yaml.v2", []string{"gopkg.in", "yaml.v2"}},
+		{"github.com/go-yaml/yaml", []string{"github.com", "go-yaml", "yaml"}},
+		{"launchpad.net/~user/goyaml", []string{"launchpad.net", "~user",
+			"goyaml"}},
+	} {
+		if tokens := tokenize(CheckPathRuneType, c.text); !reflect.DeepEqual(
+				tokens, c.tokens) {
+			t.Errorf("CheckPathRuneType tokens of %q = %q, want %q", c.text,
+				tokens, c.tokens)
+		}
+	}
+}
+
+func TestAnalyzers(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		a     Analyzer
+		text  string
+		terms []string
+	}{
+		{"name", nameAnalyzer, "HTTPServer", []string{"httpserver", "http",
+			"server", "http-server"}},
+		{"name", nameAnalyzer, "snake_case", []string{"snake_case", "snake",
+			"case", "snake-case", "snakecase"}},
+		{"package", packageAnalyzer, "gopkg.in/yaml.v2", []string{"gopkg.in",
+			"gopkg", "in", "gopkg-in", "yaml.v2", "yaml", "v2", "yaml-v2"}},
+		{"package", packageAnalyzer, "launchpad.net/~user/go-yaml", []string{
+			"launchpad.net", "launchpad", "net", "launchpad-net", "user",
+			"go-yaml", "go", "yaml", "go-yaml", "goyaml"}},
+		// prose is not split into the words of identifiers
+		{"text", textAnalyzer, "An HTTPServer on yaml.v2", []string{"an",
+			"httpserver", "yaml", "v2"}},
+		{"text", textAnalyzer, "see http://example.com/x now", []string{"see",
+			"now"}},
+		{"text", textAnalyzer, "Go语言", []string{"go", "语", "言", "语言"}},
+		{"readme", readmeAnalyzer, "[GoDoc](https://godoc.org/x) <b>fast</b>",
+			[]string{"godoc", "fast"}},
+	} {
+		if terms := c.a.Analyze(c.text); !reflect.DeepEqual(terms, c.terms) {
+			t.Errorf("%s analyzer terms of %q = %q, want %q", c.name, c.text,
+				terms, c.terms)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package gocode
+
+import (
+	"appengine"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ApiHit is a search result in the JSON API.
+type ApiHit struct {
+	Name          string
+	Package       string
+	Author        string
+	Synopsis      string
+	ProjectURL    string
+	StarCount     int
+	ImportedCount int
+	License       string
+	// zero if unknown
+	LastCommit    time.Time
+	Archived      bool
+	Deprecated    bool
+	Advisories    []string `json:",omitempty"`
+	Score         float64
+	MatchScore    float64
+	StaticScore   float64
+	// set on explain=1
+	Explain *Explanation `json:",omitempty"`
+}
+
+// ApiSearchResponse is the response of /api/search.
+type ApiSearchResponse struct {
+	Query        string
+	// the import path searched instead of Query, which was moved to it
+	MovedTo      string `json:",omitempty"`
+	Suggestion   string `json:",omitempty"`
+	Corrected    bool
+	TotalResults int
+	// true if TotalResults and Facets count only part of the results
+	Partial      bool `json:",omitempty"`
+	Facets       []Facet
+	Hits         []ApiHit
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func newApiHit(d *DocInfo) ApiHit {
+	return ApiHit{
+		Name:          d.Name,
+		Package:       d.Package,
+		Author:        d.Author,
+		Synopsis:      d.Synopsis,
+		ProjectURL:    d.ProjectURL,
+		StarCount:     d.StarCount,
+		ImportedCount: len(d.ImportedPkgs),
+		License:       d.License,
+		LastCommit:    d.LastCommit,
+		Archived:      d.Archived,
+		Deprecated:    d.Deprecated,
+		Advisories:    d.Advisories,
+		Score:         d.Score,
+		MatchScore:    d.MatchScore,
+		StaticScore:   d.StaticScore,
+	}
+}
+
+// apiSearch returns a page of ranked results of q as JSON. Parameters, including
+// the sort order and filters, are the same as those of /search. A q of a moved
+// import path is searched by the new path.
+func apiSearch(w http.ResponseWriter, r *http.Request) {
+	// current page, 1-based
+	p, err := strconv.Atoi(r.FormValue("p"))
+	if err != nil || p < 1 {
+		p = 1
+	}
+	
+	c := appengine.NewContext(r)
+	q := strings.TrimSpace(r.FormValue("q"))
+	movedTo := movedPath(c, q)
+	sq := q
+	if movedTo != "" {
+		sq = movedTo
+	}
+	results, _, err := searchWithSuggestion(c, sq, parseSearchOptions(r),
+		p*itemsPerPage, r.FormValue("nocorrect") == "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	
+	resp := ApiSearchResponse{
+		Query:        q,
+		MovedTo:      movedTo,
+		Suggestion:   results.Suggestion,
+		Corrected:    results.Corrected,
+		TotalResults: results.TotalResults,
+		Partial:      results.Partial,
+		Facets:       results.Facets,
+		Hits:         []ApiHit{},
+	}
+	start := (p - 1) * itemsPerPage
+	if start < len(results.Hits) && r.FormValue("explain") != "" {
+		explainHits(c, resultsQuery(sq, results), results.Hits[start:])
+	}
+	for i := start; i < len(results.Hits); i++ {
+		hit := newApiHit(results.Hits[i].Doc)
+		hit.Explain = results.Hits[i].Explain
+		resp.Hits = append(resp.Hits, hit)
+	}
+	writeJSON(w, resp)
+}
@@ -0,0 +1,392 @@
+package gocode
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"github.com/daviddengcn/go-code-crawl"
+	"github.com/daviddengcn/go-villa"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The authority of an author is aggregated over the indexed packages of the
+// author, the same as those on the author page. Pushed persons are queued in
+// kindAuthorToUpdate and aggregated by the /index cron. The authority is saved
+// in kindAuthor by the id of the crawler-person, and copied to
+// DocInfo.AuthorScore of the author's packages so that calcStaticRank can
+// blend it in.
+const (
+	// the upper bound of AuthorInfo.Score
+	maxAuthorScore = 4.
+	// the weight of DocInfo.AuthorScore in the static score
+	authorScoreWeight = 0.5
+	// packages are rescored when the authority changes more than this
+	authorScoreDelta = 0.1
+	// the maximum number of authors aggregated in one pass
+	maxAuthorsToUpdate = 100
+)
+
+type AuthorInfo struct {
+	// the number of indexed packages of the author
+	Packages int `datastore:",noindex"`
+	// the total number of importers of the packages
+	Importers int `datastore:",noindex"`
+	// the total number of stars of the packages
+	Stars int `datastore:",noindex"`
+	// the number of distinct other authors importing the packages
+	ImportingAuthors int       `datastore:",noindex"`
+	Score            float64   `datastore:",noindex"`
+	Updated          time.Time `datastore:",noindex"`
+}
+
+// personOfPackage returns the id of the crawler-person of the author of pkg,
+// "" if the site of pkg has no persons.
+func personOfPackage(pkg string) string {
+	for _, site := range []string{"github.com", "bitbucket.org"} {
+		if strings.HasPrefix(pkg, site+"/") {
+			return gcc.IdOfPerson(site, authorOfPackage(pkg))
+		}
+	}
+	return ""
+}
+
+// authorityScore returns the authority of an author. Importing authors count
+// the most as they are the hardest to fake.
+func authorityScore(a *AuthorInfo) float64 {
+	s := 0.5*math.Log(1+float64(a.ImportingAuthors)) +
+		0.25*math.Log(1+float64(a.Importers)) +
+		0.1*math.Log(1+float64(a.Stars))
+	return minFloat(s, maxAuthorScore)
+}
+
+// authorScore returns the saved authority of the author of pkg, 0 if unknown.
+func authorScore(c appengine.Context, pkg string) float64 {
+	id := personOfPackage(pkg)
+	if id == "" {
+		return 0
+	}
+	
+	var a AuthorInfo
+	err, _ := NewCachedDocDB(c, kindAuthor).Get(id, &a)
+	if err != nil {
+		c.Errorf("Get(%s, %s) failed: %v", kindAuthor, id, err)
+	}
+	return a.Score
+}
+
+// updateAuthor aggregates the authority of person id over its indexed
+// packages, including sub-packages. If the authority changes much, the
+// packages are queued in kindToUpdate to be rescored.
+func updateAuthor(c appengine.Context, id string) error {
+	docs, err := authorPackages(c, id)
+	if err != nil {
+		return err
+	}
+	
+	var a AuthorInfo
+	importingAuthors := make(villa.StrSet)
+	var indexed []string
+	for i := range docs {
+		d := &docs[i]
+		indexed = append(indexed, d.Package)
+		a.Packages++
+		a.Importers += len(d.ImportedPkgs)
+		if d.StarCount > 0 {
+			a.Stars += d.StarCount
+		}
+		for _, imp := range d.ImportedPkgs {
+			// importers on hosts without persons are not authors
+			if author := personOfPackage(imp); author != "" && author != id {
+				importingAuthors.Put(author)
+			}
+		}
+	}
+	a.ImportingAuthors = len(importingAuthors)
+	a.Score = authorityScore(&a)
+	a.Updated = time.Now()
+	
+	ddb := NewCachedDocDB(c, kindAuthor)
+	var last AuthorInfo
+	if err, _ := ddb.Get(id, &last); err != nil {
+		c.Errorf("Get(%s, %s) failed: %v", kindAuthor, id, err)
+	}
+	if err := ddb.Put(id, &a); err != nil {
+		return err
+	}
+	c.Infof("Authority of %s: %f -> %f", id, last.Score, a.Score)
+	
+	if math.Abs(a.Score-last.Score) > authorScoreDelta && len(indexed) > 0 {
+		errs := NewDocDB(c, kindToUpdate).PutMulti(indexed,
+			make([]struct{}, len(indexed)))
+		if errs.ErrorCount() > 0 {
+			c.Errorf("PutMulti(%d packages) to %s with %d failed: %v",
+				len(indexed), kindToUpdate, errs.ErrorCount(), errs)
+		}
+	}
+	return nil
+}
+
+// queueAuthor queues the person id for aggregating its authority.
+func queueAuthor(c appengine.Context, id string) {
+	err := NewDocDB(c, kindAuthorToUpdate).Put(id, &struct{}{})
+	if err != nil {
+		c.Errorf("Put(%s, %s) failed: %v", kindAuthorToUpdate, id, err)
+	}
+}
+
+// processAuthorsToUpdate aggregates the authority of the queued persons for
+// at most ttl. Returns the number of persons processed.
+func processAuthorsToUpdate(c appengine.Context, ttl time.Duration) int {
+	start := time.Now()
+	keys, err := datastore.NewQuery(kindAuthorToUpdate).KeysOnly().
+		Limit(maxAuthorsToUpdate).GetAll(c, nil)
+	if err != nil {
+		c.Errorf("Query %s failed: %v", kindAuthorToUpdate, err)
+		return 0
+	}
+	
+	ddb := NewDocDB(c, kindAuthorToUpdate)
+	i := 0
+	for ; i < len(keys); i++ {
+		if time.Now().Sub(start) > ttl {
+			c.Infof("%v elapsed, quit with %d authors processed", ttl, i)
+			break
+		}
+		
+		id := keys[i].StringID()
+		if err := updateAuthor(c, id); err != nil {
+			// kept in the queue to retry
+			c.Errorf("updateAuthor(%s) failed: %v", id, err)
+			continue
+		}
+		if err := ddb.Delete(id); err != nil {
+			c.Errorf("Delete(%s) in %s failed: %v", id, kindAuthorToUpdate, err)
+		}
+	}
+	return i
+}
+
+// the maximum number of packages shown on an author page
+const maxAuthorPackages = 1000
+
+// AuthorPackage is an indexed package of an author.
+type AuthorPackage struct {
+	Package       string
+	Name          string
+	Synopsis      string
+	StarCount     int
+	ImportedCount int
+}
+
+// AuthorImporter is another author, or a host of packages without authors,
+// depending on packages of an author.
+type AuthorImporter struct {
+	// the crawler-person id, or the host if Person is false
+	Author string
+	Person bool
+	// the number of importing packages of Author
+	Importers int
+	// the packages of the author imported
+	Imported []string
+}
+
+// CrawlStatus is the state of the crawler-person entry of an author.
+type CrawlStatus struct {
+	ScheduleTime  time.Time
+	CrawlInterval time.Duration
+	Leased        bool
+	FailureCount  int
+	LastFailure   string `json:",omitempty"`
+}
+
+// AuthorProfile is the content of /author and /api/author.
+type AuthorProfile struct {
+	ID       string
+	Site     string
+	Username string
+	URL      string
+	// nil if the authority was never computed
+	Authority *AuthorInfo `json:",omitempty"`
+	// nil if the person is not to be crawled
+	Crawl          *CrawlStatus `json:",omitempty"`
+	TotalStars     int
+	TotalImporters int
+	Packages       []AuthorPackage
+	Importers      []AuthorImporter
+}
+
+// authorPackages returns the indexed packages of the person id, including
+// sub-packages.
+func authorPackages(c appengine.Context, id string) ([]DocInfo, error) {
+	site, username := gcc.ParsePersonId(id)
+	return prefixDocs(c, site+"/"+username+"/", maxAuthorPackages)
+}
+
+// authorImporters groups the importers of docs, the packages of the person
+// id, by their authors, most importers first.
+func authorImporters(docs []DocInfo, id string) []AuthorImporter {
+	byAuthor := make(map[string]*AuthorImporter)
+	importers := make(map[string]villa.StrSet)
+	for _, d := range docs {
+		for _, imp := range d.ImportedPkgs {
+			author, person := personOfPackage(imp), true
+			if author == id {
+				continue
+			}
+			if author == "" {
+				author, person = authorOfPackage(imp), false
+			}
+			ai, ok := byAuthor[author]
+			if !ok {
+				ai = &AuthorImporter{Author: author, Person: person}
+				byAuthor[author] = ai
+			}
+			set := importers[author]
+			set.Put(imp)
+			importers[author] = set
+			if len(ai.Imported) == 0 || ai.Imported[len(ai.Imported)-1] != d.Package {
+				ai.Imported = append(ai.Imported, d.Package)
+			}
+		}
+	}
+	
+	res := make([]AuthorImporter, 0, len(byAuthor))
+	for author, ai := range byAuthor {
+		ai.Importers = len(importers[author])
+		res = append(res, *ai)
+	}
+	villa.SortF(len(res), func(i, j int) bool {
+		if res[i].Importers != res[j].Importers {
+			return res[i].Importers > res[j].Importers
+		}
+		return res[i].Author < res[j].Author
+	}, func(i, j int) {
+		res[i], res[j] = res[j], res[i]
+	})
+	return res
+}
+
+// loadAuthorProfile returns the profile of the person id, nil if the author
+// is unknown.
+func loadAuthorProfile(c appengine.Context, id string) (*AuthorProfile, error) {
+	site, username := gcc.ParsePersonId(id)
+	if site == "" || username == "" {
+		return nil, nil
+	}
+	
+	p := &AuthorProfile{
+		ID:       id,
+		Site:     site,
+		Username: username,
+		URL:      "https://" + site + "/" + username,
+	}
+	
+	var a AuthorInfo
+	err, exists := NewCachedDocDB(c, kindAuthor).Get(id, &a)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		p.Authority = &a
+	}
+	
+	ent, err := findCrawlingEntry(c, kindCrawlerPerson, id)
+	if err != nil {
+		return nil, err
+	}
+	if ent != nil {
+		p.Crawl = &CrawlStatus{
+			ScheduleTime:  ent.ScheduleTime,
+			CrawlInterval: ent.CrawlInterval,
+			Leased:        ent.leased(time.Now()),
+			FailureCount:  ent.FailureCount,
+			LastFailure:   ent.LastFailure,
+		}
+	}
+	
+	docs, err := authorPackages(c, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(docs) == 0 && ent == nil && !exists {
+		return nil, nil
+	}
+	
+	for _, d := range docs {
+		stars := d.StarCount
+		if stars < 0 {
+			stars = 0
+		}
+		p.Packages = append(p.Packages, AuthorPackage{
+			Package:       d.Package,
+			Name:          d.Name,
+			Synopsis:      d.Synopsis,
+			StarCount:     stars,
+			ImportedCount: len(d.ImportedPkgs),
+		})
+		p.TotalStars += stars
+		p.TotalImporters += len(d.ImportedPkgs)
+	}
+	pkgs := p.Packages
+	villa.SortF(len(pkgs), func(i, j int) bool {
+		if pkgs[i].ImportedCount != pkgs[j].ImportedCount {
+			return pkgs[i].ImportedCount > pkgs[j].ImportedCount
+		}
+		if pkgs[i].StarCount != pkgs[j].StarCount {
+			return pkgs[i].StarCount > pkgs[j].StarCount
+		}
+		return pkgs[i].Package < pkgs[j].Package
+	}, func(i, j int) {
+		pkgs[i], pkgs[j] = pkgs[j], pkgs[i]
+	})
+	p.Importers = authorImporters(docs, id)
+	return p, nil
+}
+
+// pageAuthor shows the profile of the author ?id=site:username.
+func pageAuthor(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	p, err := loadAuthorProfile(c, strings.TrimSpace(r.FormValue("id")))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if p == nil {
+		if to := movedPerson(c, strings.TrimSpace(r.FormValue("id"))); to != "" {
+			http.Redirect(w, r, "author?id="+url.QueryEscape(to),
+				http.StatusMovedPermanently)
+			return
+		}
+		http.Error(w, "No such author", http.StatusNotFound)
+		return
+	}
+	
+	if err := templates.ExecuteTemplate(w, "author.html", p); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// apiAuthor returns the profile of the author ?id=site:username as JSON. An
+// author whose packages moved is redirected to the new one.
+func apiAuthor(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	id := strings.TrimSpace(r.FormValue("id"))
+	p, err := loadAuthorProfile(c, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if p == nil {
+		if to := movedPerson(c, id); to != "" {
+			http.Redirect(w, r, "author?id="+url.QueryEscape(to),
+				http.StatusMovedPermanently)
+			return
+		}
+		http.Error(w, "No such author", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, p)
+}
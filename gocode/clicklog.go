@@ -0,0 +1,133 @@
+package gocode
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/delay"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// a click on an impression not saved after this is dropped
+const maxClickDelay = 10 * time.Minute
+
+func init() {
+	rand.Seed(time.Now().UnixNano())
+}
+
+// Impression is a page of search results shown to a user.
+type Impression struct {
+	Query string
+	Time  time.Time
+	Sort  string `datastore:",noindex"`
+	Page  int    `datastore:",noindex"`
+	// the packages on the page, in order
+	Packages []string `datastore:",noindex"`
+}
+
+// Click is a click on a result of an impression.
+type Click struct {
+	Impression int64
+	Query      string
+	Package    string `datastore:",noindex"`
+	// 1-based position of the result in all results
+	Position int `datastore:",noindex"`
+	Time     time.Time
+}
+
+// newImpressionID returns a random positive id, which needs no datastore
+// round trip and doesn't collide in practice.
+func newImpressionID() int64 {
+	for {
+		if id := rand.Int63(); id > 0 {
+			return id
+		}
+	}
+}
+
+// putImpression saves imp with the id in a task.
+var putImpression = delay.Func("putImpression", func(c appengine.Context,
+		id int64, imp Impression) {
+	_, err := datastore.Put(c, datastore.NewKey(c, kindImpression, "", id, nil),
+		&imp)
+	if err != nil {
+		c.Errorf("Put %s %d failed: %v", kindImpression, id, err)
+	}
+})
+
+// logImpression saves the page p of results of q in a task, and returns its
+// id.
+func logImpression(c appengine.Context, q string, opts SearchOptions, p int,
+		docs []ShowDocInfo) int64 {
+	imp := Impression{
+		Query: normQuery(q),
+		Time:  time.Now(),
+		Sort:  opts.Sort,
+		Page:  p,
+	}
+	for _, d := range docs {
+		imp.Packages = append(imp.Packages, d.Package)
+	}
+	
+	id := newImpressionID()
+	putImpression.Call(c, id, imp)
+	return id
+}
+
+var errImpressionNotSaved = errors.New("impression not saved yet")
+
+// logClick saves a click in a task. The task is retried while the impression
+// is not saved.
+var logClick = delay.Func("logClick", func(c appengine.Context, impID int64,
+		pos int, pkg string, t time.Time) error {
+	var imp Impression
+	err := datastore.Get(c, datastore.NewKey(c, kindImpression, "", impID, nil),
+		&imp)
+	if err == datastore.ErrNoSuchEntity {
+		if time.Now().Sub(t) < maxClickDelay {
+			return errImpressionNotSaved
+		}
+		c.Infof("Click on unknown impression %d dropped", impID)
+		return nil
+	}
+	if !DocGetOk(err) {
+		return err
+	}
+	
+	// only clicks on what was shown are logged
+	idx := pos - 1 - (imp.Page-1)*itemsPerPage
+	if idx < 0 || idx >= len(imp.Packages) || imp.Packages[idx] != pkg {
+		c.Infof("Click on %s at %d not in impression %d dropped", pkg, pos,
+			impID)
+		return nil
+	}
+	
+	_, err = datastore.Put(c, datastore.NewIncompleteKey(c, kindClick, nil),
+		&Click{
+			Impression: impID,
+			Query:      imp.Query,
+			Package:    pkg,
+			Position:   pos,
+			Time:       t,
+		})
+	return err
+})
+
+// pageClick logs a click, sent by js/click.js, on the result at position pos,
+// which is package id, of impression imp.
+func pageClick(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	impID, _ := strconv.ParseInt(r.FormValue("imp"), 10, 64)
+	pos, _ := strconv.Atoi(r.FormValue("pos"))
+	pkg := r.FormValue("id")
+	if impID <= 0 || pos <= 0 || pkg == "" {
+		http.Error(w, "invalid click", http.StatusBadRequest)
+		return
+	}
+	
+	logClick.Call(c, impID, pos, pkg, time.Now())
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -5,9 +5,11 @@ import (
 	"appengine/datastore"
 	"appengine/memcache"
 	"errors"
+	"fmt"
 	"github.com/daviddengcn/gddo/doc"
 	"github.com/daviddengcn/go-code-crawl"
 	"log"
+	"math"
 	"math/rand"
 	"net/http"
 	"net/url"
@@ -24,11 +26,87 @@ func init() {
 const (
 	DefaultPackageAge = 10 * 24 * time.Hour
 	DefaultPersonAge  = 10 * 24 * time.Hour
+
+	// bounds of the adaptive crawling intervals
+	MinPackageAge = 1 * 24 * time.Hour
+	MaxPackageAge = 60 * 24 * time.Hour
+	MinPersonAge  = 2 * 24 * time.Hour
+	MaxPersonAge  = 60 * 24 * time.Hour
+
+	// a leased entry not acknowledged within this duration goes back to the
+	// crawling queue
+	CrawlLeaseTimeout = time.Hour
+
+	// a package is deleted after this number of consecutive permanent failures
+	// by default, see CrawlerSettings
+	DefaultMaxPermanentFailures = 3
+	// base delays of retrying after a failure, doubled on each consecutive one
+	TransientRetryDelay = 10 * time.Minute
+	RateLimitRetryDelay = time.Hour
+	MaxRetryDelay       = 24 * time.Hour
 )
 
+// reasons of a BadPackageReport
+const (
+	BadPackageNotFound    = "not-found"
+	BadPackageNotGo       = "not-go"
+	BadPackageRateLimited = "rate-limited"
+	BadPackageNetwork     = "network"
+	// reported by ReportBadPackage without a reason
+	BadPackageUnknown = "unknown"
+	// the package was moved or renamed to BadPackageReport.MovedTo, detected
+	// by a redirect of the host
+	BadPackageMoved = "moved"
+)
+
+// BadPackageReport is sent by the crawler when a package failed to crawl.
+type BadPackageReport struct {
+	Package string
+	// the lease under which the package was crawled, may be empty
+	LeaseID string
+	// one of the BadPackageXXX constants
+	Reason  string
+	Message string
+	// the new import path if Reason is BadPackageMoved
+	MovedTo string
+}
+
+// permanentFailure returns true if crawling again is unlikely to succeed.
+// Unknown reasons are regarded as transient.
+func permanentFailure(reason string) bool {
+	return reason == BadPackageNotFound || reason == BadPackageNotGo
+}
+
 type CrawlingEntry struct {
 	ScheduleTime time.Time
 	Host         string
+
+	// the adaptive interval between two crawls, 0 for the default one
+	CrawlInterval time.Duration `datastore:",noindex"`
+
+	LeaseID       string    `datastore:",noindex"`
+	LeaseDeadline time.Time `datastore:",noindex"`
+
+	// consecutive failures, cleared when the package is crawled successfully
+	FailureCount      int    `datastore:",noindex"`
+	PermanentFailures int    `datastore:",noindex"`
+	LastFailure       string `datastore:",noindex"`
+	// set when the package was deleted after too many permanent failures. The
+	// entry is kept so that the package is checked again much later.
+	Tombstone bool `datastore:",noindex"`
+}
+
+// leased returns true if the entry is being crawled by someone.
+func (ent *CrawlingEntry) leased(now time.Time) bool {
+	return ent.LeaseID != "" && ent.LeaseDeadline.After(now)
+}
+
+// LeasedEntry is an entry handed out to a crawler. The lease is acknowledged
+// by pushing or reporting the entry before Deadline.
+type LeasedEntry struct {
+	ID       string
+	LeaseID  string
+	Deadline time.Time
 }
 
 func urlOfPackage(pkg string) *url.URL {
@@ -36,7 +114,50 @@ func urlOfPackage(pkg string) *url.URL {
 	return u
 }
 
-func schedulePackage(c appengine.Context, pkg string, sTime time.Time) error {
+// nextCrawlInterval doubles the interval if nothing changed since last crawl,
+// and halves it otherwise, bounded by [min, max]. The first interval is def.
+func nextCrawlInterval(last, def, min, max time.Duration, changed bool) time.Duration {
+	if last <= 0 {
+		return def
+	}
+	
+	next := last * 2
+	if changed {
+		next = last / 2
+	}
+	
+	if next < min {
+		next = min
+	}
+	if next > max {
+		next = max
+	}
+	return next
+}
+
+// boostByImporters shortens the interval of packages imported by many others.
+// The result is not less than min.
+func boostByImporters(interval, min time.Duration, importers int) time.Duration {
+	boost := 1 + math.Log10(1 + float64(importers))
+	age := time.Duration(float64(interval) / boost)
+	if age < min {
+		age = min
+	}
+	return age
+}
+
+// jitterAge returns a time in the future about age later, jittered to avoid
+// crawling many entries at the same time.
+func jitterAge(age time.Duration) time.Time {
+	return time.Now().Add(age).Add(time.Duration(rand.Int63n(int64(age)/10) -
+		int64(age)/5))
+}
+
+// schedulePackage sets the next crawling time of pkg. If interval is positive,
+// it is saved as the new crawling interval. If crawled is true, pkg was just
+// crawled successfully, which acknowledges its lease and clears its failures.
+func schedulePackage(c appengine.Context, pkg string, sTime time.Time,
+		interval time.Duration, crawled bool) error {
 	ddb := NewCachedDocDB(c, kindCrawlerPackage)
 
 	var ent CrawlingEntry
@@ -48,6 +169,14 @@ func schedulePackage(c appengine.Context, pkg string, sTime time.Time) error {
 	mayAbsent := err != nil // ddb.Get may failed even if the doc exists
 
 	ent.ScheduleTime = sTime
+	if interval > 0 {
+		ent.CrawlInterval = interval
+	}
+	if crawled {
+		ent.LeaseID, ent.LeaseDeadline = "", time.Time{}
+		ent.FailureCount, ent.PermanentFailures = 0, 0
+		ent.LastFailure, ent.Tombstone = "", false
+	}
 
 	u := urlOfPackage(pkg)
 	if u != nil {
@@ -74,6 +203,8 @@ func appendPackage(c appengine.Context, pkg string) bool {
 		// log.Printf("  [appendPackage] Not a valid remote path: %s", pkg)
 		return false
 	}
+	// crawl the new path of a moved package
+	pkg = resolveRedirect(c, pkg)
 	ddb := NewCachedDocDB(c, kindCrawlerPackage)
 
 	var ent CrawlingEntry
@@ -89,10 +220,11 @@ func appendPackage(c appengine.Context, pkg string) bool {
 		return false
 	}
 
-	return schedulePackage(c, pkg, time.Now()) == nil
+	return schedulePackage(c, pkg, time.Now(), 0, false) == nil
 }
 
-func schedulePerson(c appengine.Context, site, username string, sTime time.Time) error {
+func schedulePerson(c appengine.Context, site, username string, sTime time.Time,
+		interval time.Duration) error {
 	ddb := NewCachedDocDB(c, kindCrawlerPerson)
 
 	var ent CrawlingEntry
@@ -108,6 +240,7 @@ func schedulePerson(c appengine.Context, site, username string, sTime time.Time)
 
 	ent.ScheduleTime = sTime
 	ent.Host = site
+	ent.CrawlInterval = interval
 
 	CachedComputingInvalidate(c, hostAllKind, kindCrawlerPerson+":"+ent.Host)
 
@@ -140,10 +273,111 @@ func appendPerson(c appengine.Context, site, username string) bool {
 		return false
 	}
 
-	return schedulePerson(c, site, username, time.Now()) == nil
+	return schedulePerson(c, site, username, time.Now(), 0) == nil
+}
+
+func sameStringSet(l1, l2 []string) bool {
+	if len(l1) != len(l2) {
+		return false
+	}
+	return len(diffStringList(append([]string(nil), l1...),
+		append([]string(nil), l2...))) == 0
+}
+
+// lastPushedDoc returns the DocInfo of pkg pushed last time, either waiting
+// for indexing or indexed. Returns nil if not found.
+func lastPushedDoc(c appengine.Context, pkg string) *DocInfo {
+	var d DocInfo
+	if err, exists := NewDocDB(c, kindFetchedDoc).Get(pkg, &d); exists {
+		return &d
+	} else if err != nil {
+		c.Errorf("Get(%s, %s) failed: %v", kindFetchedDoc, pkg, err)
+	}
+	
+	if err, exists := NewCachedDocDB(c, kindDocDB).Get(pkg, &d); exists {
+		return &d
+	} else if err != nil {
+		c.Errorf("Get(%s, %s) failed: %v", kindDocDB, pkg, err)
+	}
+	
+	return nil
+}
+
+// docChanged returns true if d differs from the last pushed one in contents
+// that matter for searching.
+func docChanged(last, d *DocInfo) bool {
+	if last == nil {
+		return true
+	}
+	
+	if d.StarCount >= 0 && d.StarCount != last.StarCount {
+		// a negative StarCount means unknown
+		return true
+	}
+	
+	return d.Name != last.Name || d.Synopsis != last.Synopsis ||
+		d.Description != last.Description || d.ReadmeData != last.ReadmeData ||
+		d.License != last.License || !sameStringSet(d.Imports, last.Imports) ||
+		!d.LastCommit.Equal(last.LastCommit) || d.Archived != last.Archived ||
+		d.Deprecated != last.Deprecated ||
+		d.QualityMeasured && qualityOf(d) != qualityOf(last)
+}
+
+// isDeprecated returns true if the package doc has a paragraph starting with
+// "Deprecated:", the convention of Go doc comments.
+func isDeprecated(pkgDoc string) bool {
+	for _, para := range strings.Split(pkgDoc, "\n\n") {
+		if strings.HasPrefix(strings.TrimSpace(para), "Deprecated:") {
+			return true
+		}
+	}
+	return false
 }
 
-func pushPackage(c appengine.Context, p *gcc.Package) (succ bool) {
+// CrawledPackage is the package pushed by the crawler, a gcc.Package with more
+// information detected by the crawler.
+type CrawledPackage struct {
+	gcc.Package
+	// the import path of the same package in the repository this one was
+	// forked from, empty if not a fork
+	ForkOf string
+	// the license file, e.g. LICENSE or COPYING, of the package, or of the
+	// repository root if the package has none
+	LicenseFn   string
+	LicenseData string
+	// the time of the last commit of the repository, zero if unknown
+	LastCommit time.Time
+	// true if the repository is archived on the hosting site
+	Archived bool
+	PackageQuality
+	// the lease under which the package was crawled, may be empty
+	LeaseID string
+	// the path in the import comment of the package clause, e.g.
+	// package foo // import "example.com/foo", empty if none
+	ImportComment string
+}
+
+// pushPackage saves a crawled package. A package whose import comment names
+// another path is moved there, unless it is a fork.
+func pushPackage(c appengine.Context, p *CrawledPackage) (succ bool) {
+	ent, err := findCrawlingEntry(c, kindCrawlerPackage, p.ImportPath)
+	if err != nil {
+		c.Errorf("[pushPackage] Get(crawler, %s) failed: %v", p.ImportPath, err)
+	}
+	if ent != nil && p.LeaseID != "" && p.LeaseID != ent.LeaseID &&
+			ent.leased(time.Now()) {
+		c.Infof("[pushPackage] Stale push of %s under lease %s ignored",
+			p.ImportPath, p.LeaseID)
+		return false
+	}
+	
+	if to := p.ImportComment; to != "" && to != p.ImportPath && p.ForkOf == "" &&
+			doc.IsValidRemotePath(to) {
+		c.Infof("[pushPackage] Import comment of %s is %s", p.ImportPath, to)
+		movePackage(c, p.ImportPath, to)
+		return false
+	}
+	
 	// copy Package as a DocInfo
 	d := DocInfo {
 		Name:        p.Name,
@@ -156,6 +390,17 @@ func pushPackage(c appengine.Context, p *gcc.Package) (succ bool) {
 		StarCount:   p.StarCount,
 		ReadmeFn:    p.ReadmeFn,
 		ReadmeData:  p.ReadmeData,
+		ForkOf:      p.ForkOf,
+		License:     packageLicense(c, p),
+		LastCommit:  p.LastCommit,
+		Archived:    p.Archived,
+		Deprecated:  isDeprecated(p.Doc),
+
+		QualityMeasured: p.QualityMeasured,
+		HasTests:        p.HasTests,
+		HasExamples:     p.HasExamples,
+		DocCoverage:     p.DocCoverage,
+		VetIssues:       p.VetIssues,
 	}
 
 	d.Imports = nil
@@ -164,10 +409,21 @@ func pushPackage(c appengine.Context, p *gcc.Package) (succ bool) {
 			d.Imports = append(d.Imports, imp)
 		}
 	}
+	d.Fingerprint = docFingerprint(&d)
+	
+	last := lastPushedDoc(c, d.Package)
+	changed := docChanged(last, &d)
+	importers := 0
+	if last != nil {
+		importers = len(last.ImportedPkgs)
+	}
+	
+	// the path is valid again if it was redirected
+	clearRedirect(c, d.Package)
 	
 	// save DocInfo into fetchedDoc DB
 	ddb := NewDocDB(c, kindFetchedDoc)
-	err := ddb.Put(d.Package, &d)
+	err = ddb.Put(d.Package, &d)
 	if err != nil {
 		c.Errorf("ddb.Put(%s) failed: %v", err)
 		return false
@@ -188,10 +444,19 @@ func pushPackage(c appengine.Context, p *gcc.Package) (succ bool) {
 		appendPackage(c, ref)
 	}
 
-	schedulePackage(c, d.Package, time.Now().Add(DefaultPackageAge).Add(
-		time.Duration(rand.Int63n(int64(DefaultPackageAge)/10)-
-			int64(DefaultPackageAge)/5)))
-			
+	var lastInterval time.Duration
+	if ent != nil {
+		lastInterval = ent.CrawlInterval
+	}
+	interval := nextCrawlInterval(lastInterval, DefaultPackageAge,
+		MinPackageAge, MaxPackageAge, changed)
+	c.Infof("Package %s changed: %v, crawl interval %v -> %v, %d importers",
+		d.Package, changed, lastInterval, interval, importers)
+	
+	schedulePackage(c, d.Package, jitterAge(boostByImporters(interval,
+		MinPackageAge, importers)), interval, true)
+		
+
 	return true
 }
 
@@ -203,14 +468,103 @@ func pushPerson(c appengine.Context, p *gcc.Person) (hasNewPkg bool) {
 	}
 
 	site, username := gcc.ParsePersonId(p.Id)
+	queueAuthor(c, p.Id)
+
+	// a person changes when new packages are found
+	var lastInterval time.Duration
+	if ent, _ := findCrawlingEntry(c, kindCrawlerPerson, p.Id); ent != nil {
+		lastInterval = ent.CrawlInterval
+	}
+	interval := nextCrawlInterval(lastInterval, DefaultPersonAge,
+		MinPersonAge, MaxPersonAge, hasNewPkg)
 
-	schedulePerson(c, site, username, time.Now().Add(DefaultPersonAge).Add(
-		time.Duration(rand.Int63n(int64(DefaultPersonAge)/10)-
-			int64(DefaultPersonAge)/5)))
+	schedulePerson(c, site, username, jitterAge(interval), interval)
 
 	return
 }
 
+// retryDelay returns base doubled for each consecutive failure, not more than
+// MaxRetryDelay.
+func retryDelay(base time.Duration, failures int) time.Duration {
+	delay := base
+	for i := 1; i < failures && delay < MaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > MaxRetryDelay {
+		delay = MaxRetryDelay
+	}
+	return delay
+}
+
+// reportBadPackage records a crawling failure of a package. Transient failures
+// are retried with backoff. The package is deleted from the index after
+// CrawlerSettings.MaxPermanentFailures consecutive permanent failures, leaving
+// a tombstone in the crawler.
+func reportBadPackage(c appengine.Context, rep *BadPackageReport) {
+	pkg := rep.Package
+	if rep.Reason == BadPackageMoved && doc.IsValidRemotePath(rep.MovedTo) {
+		movePackage(c, pkg, rep.MovedTo)
+		return
+	}
+	
+	ddb := NewCachedDocDB(c, kindCrawlerPackage)
+	
+	var ent CrawlingEntry
+	err, exists := ddb.Get(pkg, &ent)
+	if err != nil {
+		c.Errorf("[reportBadPackage] Get(crawler, %s) failed: %v", pkg, err)
+		return
+	}
+	if !exists {
+		c.Infof("[reportBadPackage] Package %s is not in crawler", pkg)
+		return
+	}
+	
+	now := time.Now()
+	if rep.LeaseID != "" && rep.LeaseID != ent.LeaseID && ent.leased(now) {
+		c.Infof("[reportBadPackage] Stale report of %s under lease %s ignored",
+			pkg, rep.LeaseID)
+		return
+	}
+	
+	ent.LeaseID, ent.LeaseDeadline = "", time.Time{}
+	ent.FailureCount++
+	ent.LastFailure = rep.Reason
+	
+	var delay time.Duration
+	switch {
+	case permanentFailure(rep.Reason):
+		ent.PermanentFailures++
+		if ent.PermanentFailures >= crawlerSettings(c).MaxPermanentFailures {
+			c.Infof("[reportBadPackage] %d permanent failures of %s, deleting",
+				ent.PermanentFailures, pkg)
+			deleteIndexedPackage(c, pkg)
+			ent.Tombstone = true
+			delay = MaxPackageAge
+		} else {
+			delay = retryDelay(MinPackageAge, ent.PermanentFailures)
+		}
+		
+	case rep.Reason == BadPackageRateLimited:
+		// permanent failures are counted only when consecutive
+		ent.PermanentFailures = 0
+		delay = retryDelay(RateLimitRetryDelay, ent.FailureCount)
+		
+	default:
+		ent.PermanentFailures = 0
+		delay = retryDelay(TransientRetryDelay, ent.FailureCount)
+	}
+	ent.ScheduleTime = now.Add(delay)
+	
+	if err := ddb.Put(pkg, &ent); err != nil {
+		c.Errorf("[reportBadPackage] Put(crawler, %s) failed: %v", pkg, err)
+		return
+	}
+	
+	c.Infof("Package %s failed (%s: %s) %d times, retry at %v", pkg, rep.Reason,
+		rep.Message, ent.FailureCount, ent.ScheduleTime)
+}
+
 // debug function //
 func tryCrawlPackage(c appengine.Context, w http.ResponseWriter, pkg string) {
 }
@@ -358,29 +712,121 @@ func clearCrawlEntriesInCache(c appengine.Context, kind string){
 	memcache.Delete(c, mcID)
 }
 
-func listCrawlEntries(c appengine.Context, kind string, l int) (pkgs []string) {
+func newLeaseID(now time.Time) string {
+	return fmt.Sprintf("%x-%x", now.UnixNano(), rand.Int63())
+}
+
+// leaseCrawlEntry leases the entry if it is still due. Returns nil if the entry
+// was removed, rescheduled or leased by another crawler in the mean time.
+func leaseCrawlEntry(c appengine.Context, kind, id string, now time.Time) (*LeasedEntry, error) {
+	var leased *LeasedEntry
+	key := datastore.NewKey(c, kind, id, 0, nil)
+	err := datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		leased = nil
+		
+		var ent CrawlingEntry
+		if err := datastore.Get(tc, key, &ent); !DocGetOk(err) {
+			return err
+		}
+		
+		if !ent.ScheduleTime.Before(now) {
+			return nil
+		}
+		
+		if ent.LeaseID != "" {
+			c.Infof("Lease %s of %s expired at %v", ent.LeaseID, id,
+				ent.LeaseDeadline)
+		}
+
+		ent.LeaseID = newLeaseID(now)
+		ent.LeaseDeadline = now.Add(CrawlLeaseTimeout)
+		// Moving ScheduleTime to the deadline hides the entry from other
+		// crawlers, and returns it to the queue once the lease expires.
+		ent.ScheduleTime = ent.LeaseDeadline
+		if _, err := datastore.Put(tc, key, &ent); err != nil {
+			return err
+		}
+		
+		leased = &LeasedEntry{
+			ID:       id,
+			LeaseID:  ent.LeaseID,
+			Deadline: ent.LeaseDeadline,
+		}
+		return nil
+	}, nil)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	
+	NewCachedDocDB(c, kind).Invalidate(id)
+	return leased, nil
+}
+
+// leaseCrawlEntries leases at most l entries of ids, returns the leased ones
+// and the number of ids consumed.
+func leaseCrawlEntries(c appengine.Context, kind string, ids []string, l int) (
+		ents []LeasedEntry, consumed int) {
+	now := time.Now()
+	for _, id := range ids {
+		if len(ents) >= l {
+			break
+		}
+		consumed++
+		
+		ent, err := leaseCrawlEntry(c, kind, id, now)
+		if err != nil {
+			c.Errorf("leaseCrawlEntry(%s, %s) failed: %v", kind, id, err)
+			continue
+		}
+		if ent != nil {
+			ents = append(ents, *ent)
+		}
+	}
+	return ents, consumed
+}
+
+// leasedIDs returns the IDs of ents.
+func leasedIDs(ents []LeasedEntry) []string {
+	ids := make([]string, len(ents))
+	for i, ent := range ents {
+		ids[i] = ent.ID
+	}
+	return ids
+}
+
+func listCrawlEntries(c appengine.Context, kind string, l int) (ents []LeasedEntry) {
 	if kind != kindCrawlerPackage && kind != kindCrawlerPerson {
 		return nil
 	}
 	
 	if l < 0 || l >= maxCrawlEntriesInCache {
-		return queryCrawlEntries(c, kind, l)
+		ids := queryCrawlEntries(c, kind, l)
+		if l < 0 {
+			l = len(ids)
+		}
+		ents, _ = leaseCrawlEntries(c, kind, ids, l)
+		return ents
 	}
 	
 	cachedPkgs := crawlEntriesInCache(c, kind)
 	c.Infof("%d %s entries in cache", len(cachedPkgs), kind)
-	if len(cachedPkgs) < l {
+	
+	// lease from cache, entries leased by others are skipped
+	ents, consumed := leaseCrawlEntries(c, kind, cachedPkgs, l)
+	cachedPkgs = cachedPkgs[consumed:]
+	if len(ents) < l {
 		// not enough entries, refetch by query
 		cachedPkgs = queryCrawlEntries(c, kind, maxCrawlEntriesInCache)
 		c.Infof("query %d %s entries", len(cachedPkgs), kind)
+		
+		more, consumed := leaseCrawlEntries(c, kind, cachedPkgs, l - len(ents))
+		ents = append(ents, more...)
+		cachedPkgs = cachedPkgs[consumed:]
 	}
-	
-	// move from cache
-	pkgs = make([]string, l)
-	l = copy(pkgs, cachedPkgs)
-	pkgs = pkgs[:l]
-	cachedPkgs = cachedPkgs[l:]
-	c.Infof("%d %s entries got, %d left", len(pkgs), kind, len(cachedPkgs))
+	c.Infof("%d %s entries leased, %d left", len(ents), kind, len(cachedPkgs))
 	
 	if len(cachedPkgs) > 0 {
 		// write back if some left
@@ -389,7 +835,7 @@ func listCrawlEntries(c appengine.Context, kind string, l int) (pkgs []string) {
 		// or clear it if nothing left
 		clearCrawlEntriesInCache(c, kind)
 	}
-	return pkgs
+	return ents
 }
 
 func touchPackage(c appengine.Context, pkg string) (earlySchedule bool) {
@@ -402,12 +848,13 @@ func touchPackage(c appengine.Context, pkg string) (earlySchedule bool) {
 	}
 
 	if exists {
-		if ent.ScheduleTime.Before(time.Now()) {
+		// due or being crawled right now
+		if ent.ScheduleTime.Before(time.Now()) || ent.leased(time.Now()) {
 			return true
 		}
 	}
 
-	err = schedulePackage(c, pkg, time.Now())
+	err = schedulePackage(c, pkg, time.Now(), 0, false)
 	if err != nil {
 		c.Errorf("[touchPackage] schedulePackage(%s) failed: %v", pkg, err)
 	}
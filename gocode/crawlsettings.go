@@ -0,0 +1,103 @@
+package gocode
+
+import (
+	"appengine"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The settings of crawling are edited on /crawlersettings.
+const (
+	crawlerSettingsID = "settings"
+	// the settings are reloaded after this interval
+	crawlerSettingsReloadInterval = 10 * time.Minute
+)
+
+// CrawlerSettings are the admin-editable settings of crawling.
+type CrawlerSettings struct {
+	// a package is deleted after this number of consecutive permanent failures
+	MaxPermanentFailures int `datastore:",noindex"`
+}
+
+func defaultCrawlerSettings() *CrawlerSettings {
+	return &CrawlerSettings{
+		MaxPermanentFailures: DefaultMaxPermanentFailures,
+	}
+}
+
+var crawlerSettingsCache struct {
+	sync.Mutex
+	s        *CrawlerSettings
+	loadTime time.Time
+}
+
+func loadCrawlerSettings(c appengine.Context) *CrawlerSettings {
+	var s CrawlerSettings
+	err, exists := NewDocDB(c, kindCrawlerSettings).Get(crawlerSettingsID, &s)
+	if err != nil {
+		c.Errorf("Get(%s, %s) failed: %v", kindCrawlerSettings,
+			crawlerSettingsID, err)
+	}
+	if !exists {
+		return defaultCrawlerSettings()
+	}
+	return &s
+}
+
+func saveCrawlerSettings(c appengine.Context, s *CrawlerSettings) error {
+	if err := NewDocDB(c, kindCrawlerSettings).Put(crawlerSettingsID, s); err != nil {
+		return err
+	}
+
+	crawlerSettingsCache.Lock()
+	crawlerSettingsCache.loadTime = time.Time{}
+	crawlerSettingsCache.Unlock()
+	return nil
+}
+
+// crawlerSettings returns the current settings, reloading them if expired.
+func crawlerSettings(c appengine.Context) *CrawlerSettings {
+	crawlerSettingsCache.Lock()
+	defer crawlerSettingsCache.Unlock()
+
+	if crawlerSettingsCache.s != nil &&
+			time.Now().Sub(crawlerSettingsCache.loadTime) < crawlerSettingsReloadInterval {
+		return crawlerSettingsCache.s
+	}
+
+	s := loadCrawlerSettings(c)
+	crawlerSettingsCache.s, crawlerSettingsCache.loadTime = s, time.Now()
+	return s
+}
+
+// pageCrawlerSettings shows and edits the crawler settings.
+func pageCrawlerSettings(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if r.Method == "POST" {
+		var s CrawlerSettings
+		v, err := strconv.Atoi(r.FormValue("maxpermanentfailures"))
+		if err != nil || v < 1 {
+			http.Error(w, "Invalid maximum permanent failures",
+				http.StatusBadRequest)
+			return
+		}
+		s.MaxPermanentFailures = v
+		if err := saveCrawlerSettings(c, &s); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err := templates.ExecuteTemplate(w, "crawlersettings.html", struct {
+		Settings *CrawlerSettings
+		Default  *CrawlerSettings
+	}{
+		Settings: loadCrawlerSettings(c),
+		Default:  defaultCrawlerSettings(),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
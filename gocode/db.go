@@ -11,6 +11,8 @@ const (
 	prefixCachedComputing = "cc:"  // cc:<kind>:<id>
 	prefixCachedDocDB     = "doc:" // doc:<kind>:<id>
 	prefixToCrawl         = "tc:"  // tc:<kind>
+	prefixSearchResult    = "sr:"  // sr:<generation>:<hash>
+	prefixQueryCount      = "qc:"  // qc:<query>
 )
 
 // constants for docs
@@ -29,8 +31,36 @@ const (
 	fieldImports = "import"
 	kindImports   = prefixImports + fieldImports
 	
+	kindIndexState = "index-state" // version of the summaries in kindIndex
+	
 	kindToUpdate       = "to-update"
 	kindPackageToCrawl = "to-crawl"
+	
+	kindRedirect = "redirect"
+	kindSynonym  = "synonym"
+	
+	kindSpellTerms = "spell-terms" // live shards of the spelling dictionary
+	kindSpellBuild = "spell-build" // shards being built
+	kindSpellState = "spell-state"
+	
+	kindRescoreState = "rescore-state"
+	
+	kindSuggest    = "suggest"
+	kindSuggestUpdate = "suggest-update"
+	kindQueryCount = "query-count"
+	kindQueryToCount = "query-to-count" // queries counted in memcache
+	
+	kindAuthor         = "author" // authority of crawler-persons
+	kindAuthorToUpdate = "author-to-update"
+	
+	kindQualityWeights = "quality-weights"
+	kindCrawlerSettings = "crawler-settings"
+	
+	kindRankModel  = "rank-model"
+	kindImpression = "impression"
+	kindClick      = "click"
+	
+	kindAdvisory = "advisory"
 )
 
 
@@ -43,6 +73,9 @@ func statDatabaseInfo(c appengine.Context) []DBInfo {
 	kinds := []string {
 		kindCrawlerPackage,
 		kindCrawlerPerson,
+		kindAuthor,
+		kindAuthorToUpdate,
+		kindAdvisory,
 		
 		kindFetchedDoc,
 		kindToUpdate,
@@ -50,6 +83,10 @@ func statDatabaseInfo(c appengine.Context) []DBInfo {
 		kindIndex,
 		
 		kindImports,
+		kindRedirect,
+		kindSuggest,
+		kindQueryCount,
+		kindSpellTerms,
 	}
 	
 	dbs := make([]DBInfo, len(kinds))
@@ -70,6 +107,15 @@ func deletePackage(c appengine.Context, pkg string) {
 	if err := NewCachedDocDB(c, kindCrawlerPackage).Delete(pkg); err != nil {
 		c.Errorf("Delete package %s in %s failed: %v", pkg, kindCrawlerPackage, err)
 	}
+	deleteIndexedPackage(c, pkg)
+}
+
+// deleteIndexedPackage removes pkg from searching but keeps its crawler entry.
+func deleteIndexedPackage(c appengine.Context, pkg string) {
+	var d DocInfo
+	if err, exists := NewCachedDocDB(c, kindDocDB).Get(pkg, &d); err == nil && exists {
+		removeSuggestions(c, d.Name, pkg)
+	}
 	if err := NewCachedDocDB(c, kindDocDB).Delete(pkg); err != nil {
 		c.Errorf("Delete package %s in %s failed: %v", pkg, kindDocDB, err)
 	}
@@ -79,6 +125,36 @@ func deletePackage(c appengine.Context, pkg string) {
 	if err := NewCachedDocDB(c, kindImports).Delete(pkg); err != nil {
 		c.Errorf("Delete package %s in %s failed: %v", pkg, kindImports, err)
 	}
+	bumpIndexGeneration(c)
+}
+
+// prefixDocs returns at most l documents in kindDocDB whose packages start with
+// prefix, which ends with a slash.
+func prefixDocs(c appengine.Context, prefix string, l int) ([]DocInfo, error) {
+	// keys in [prefix, prefix with the slash replaced by '0')
+	end := prefix[:len(prefix)-1] + "0"
+	keys, err := datastore.NewQuery(kindDocDB).
+		Filter("__key__ >=", datastore.NewKey(c, kindDocDB, prefix, 0, nil)).
+		Filter("__key__ <", datastore.NewKey(c, kindDocDB, end, 0, nil)).
+		KeysOnly().Limit(l).GetAll(c, nil)
+	if err != nil {
+		return nil, err
+	}
+	
+	ids := make([]string, len(keys))
+	for i, key := range keys {
+		ids[i] = key.StringID()
+	}
+	docs := make([]DocInfo, len(ids))
+	fetchDocs(c, ids, docs)
+	
+	res := docs[:0]
+	for _, d := range docs {
+		if d.Package != "" {
+			res = append(res, d)
+		}
+	}
+	return res, nil
 }
 
 func updateDocInfo(c appengine.Context, pkg string) {
@@ -153,6 +153,12 @@ func (db *CachedDocDB) Put(id string, doc interface{}) error {
 	return (*DocDB)(db).Put(id, doc)
 }
 
+// Invalidate removes the cached copy of id, e.g. after a transactional update.
+func (db *CachedDocDB) Invalidate(id string) {
+	mcID := prefixCachedDocDB + db.kind + ":" + id
+	memcache.Delete(db.c, mcID)
+}
+
 func (db *CachedDocDB) Delete(id string) error {
 	mcID := prefixCachedDocDB + db.kind + ":" + id
 	memcache.Delete(db.c, mcID)
@@ -0,0 +1,301 @@
+package gocode
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"bufio"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rank models are evaluated offline on judgments, the graded relevance of
+// packages for queries, by NDCG@evalDepth and MRR. Judgments come from logged
+// clicks, a package clicked n times for a query is graded log2(1 + n), or from
+// judgmentsFile, lines of
+//
+//     query<TAB>package<TAB>grade
+//
+// Models are trained on pairs of a clicked result and a result shown above it
+// but not clicked, by pairwise logistic regression.
+const (
+	judgmentsFile = "judgments.txt"
+	
+	// the number of top results evaluated
+	evalDepth = 10
+	// the maximum number of queries evaluated
+	maxEvalQueries = 200
+	// the maximum number of clicks read
+	maxEvalClicks = 5000
+	
+	trainEpochs       = 30
+	trainLearningRate = 0.05
+	trainL2           = 0.001
+)
+
+// Judgments are the grades of packages by queries.
+type Judgments map[string]map[string]float64
+
+func (js Judgments) add(q, pkg string, grade float64) {
+	if js[q] == nil {
+		js[q] = make(map[string]float64)
+	}
+	js[q][pkg] += grade
+}
+
+// parseJudgments parses lines of judgments.
+func parseJudgments(text string) Judgments {
+	js := make(Judgments)
+	s := bufio.NewScanner(strings.NewReader(text))
+	for s.Scan() {
+		line := s.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Split(line, "\t")
+		if len(parts) != 3 {
+			continue
+		}
+		grade, err := strconv.ParseFloat(strings.TrimSpace(parts[2]), 64)
+		if err != nil || grade <= 0 {
+			continue
+		}
+		js.add(normQuery(parts[0]), strings.TrimSpace(parts[1]), grade)
+	}
+	return js
+}
+
+func readJudgmentsFile(c appengine.Context) Judgments {
+	text, err := ioutil.ReadFile(judgmentsFile)
+	if err != nil {
+		c.Errorf("Read %s failed: %v", judgmentsFile, err)
+	}
+	return parseJudgments(string(text))
+}
+
+// recentClicks returns at most maxEvalClicks clicks since since.
+func recentClicks(c appengine.Context, since time.Time) ([]Click, error) {
+	var clicks []Click
+	_, err := datastore.NewQuery(kindClick).Filter("Time>=", since).
+		Order("-Time").Limit(maxEvalClicks).GetAll(c, &clicks)
+	if err != nil && !DocGetOk(err) {
+		return nil, err
+	}
+	return clicks, nil
+}
+
+// clickJudgments returns the judgments of clicks.
+func clickJudgments(clicks []Click) Judgments {
+	counts := make(map[string]map[string]int)
+	for _, click := range clicks {
+		if counts[click.Query] == nil {
+			counts[click.Query] = make(map[string]int)
+		}
+		counts[click.Query][click.Package]++
+	}
+	
+	js := make(Judgments)
+	for q, pkgs := range counts {
+		for pkg, n := range pkgs {
+			js.add(q, pkg, math.Log2(1+float64(n)))
+		}
+	}
+	return js
+}
+
+// dcg returns the discounted cumulative gain of grades.
+func dcg(grades []float64) float64 {
+	s := 0.
+	for i, g := range grades {
+		s += (math.Pow(2, g) - 1) / math.Log2(float64(i)+2)
+	}
+	return s
+}
+
+// ndcg returns the NDCG of the first k ranked packages.
+func ndcg(ranked []string, rel map[string]float64, k int) float64 {
+	var grades, ideal []float64
+	for i := 0; i < len(ranked) && i < k; i++ {
+		grades = append(grades, rel[ranked[i]])
+	}
+	for _, g := range rel {
+		ideal = append(ideal, g)
+	}
+	sort.Sort(sort.Reverse(sort.Float64Slice(ideal)))
+	if len(ideal) > k {
+		ideal = ideal[:k]
+	}
+	
+	idcg := dcg(ideal)
+	if idcg == 0 {
+		return 0
+	}
+	return dcg(grades) / idcg
+}
+
+// reciprocalRank returns 1/r of the first relevant package at rank r, 0 if
+// none.
+func reciprocalRank(ranked []string, rel map[string]float64) float64 {
+	for i, pkg := range ranked {
+		if rel[pkg] > 0 {
+			return 1 / float64(i+1)
+		}
+	}
+	return 0
+}
+
+// EvalResult is the mean metrics of a model over the judged queries.
+type EvalResult struct {
+	Queries int
+	NDCG    float64
+	MRR     float64
+}
+
+// evaluateModel ranks the judged queries by m and averages the metrics.
+func evaluateModel(c appengine.Context, m *RankModel, js Judgments) (
+		EvalResult, error) {
+	var res EvalResult
+	opts := SearchOptions{Sort: sortRelevance, model: m}
+	for q, rel := range js {
+		if res.Queries >= maxEvalQueries {
+			break
+		}
+		
+		results, _, err := search(c, q, opts, evalDepth)
+		if err != nil {
+			return res, err
+		}
+		var ranked []string
+		for _, hit := range results.Hits {
+			ranked = append(ranked, hit.Doc.Package)
+		}
+		
+		res.Queries++
+		res.NDCG += ndcg(ranked, rel, evalDepth)
+		res.MRR += reciprocalRank(ranked, rel)
+	}
+	if res.Queries > 0 {
+		res.NDCG /= float64(res.Queries)
+		res.MRR /= float64(res.Queries)
+	}
+	return res, nil
+}
+
+// the maximum number of impressions read by one GetMulti
+const impressionsPerGet = 1000
+
+// getImpressions returns the impressions of ids, with nil for the missing ones.
+func getImpressions(c appengine.Context, ids []int64) ([]*Impression, error) {
+	res := make([]*Impression, len(ids))
+	for i := 0; i < len(ids); i += impressionsPerGet {
+		end := i + impressionsPerGet
+		if end > len(ids) {
+			end = len(ids)
+		}
+		keys := make([]*datastore.Key, end-i)
+		for j := range keys {
+			keys[j] = datastore.NewKey(c, kindImpression, "", ids[i+j], nil)
+		}
+		imps := make([]Impression, len(keys))
+		errs := ErrorSliceFromError(datastore.GetMulti(c, keys, imps), len(keys))
+		for j, err := range errs {
+			if err == datastore.ErrNoSuchEntity {
+				continue
+			}
+			if !DocGetOk(err) {
+				return nil, err
+			}
+			res[i+j] = &imps[j]
+		}
+	}
+	return res, nil
+}
+
+// preferencePairs returns the feature differences of clicked results minus
+// the results above them which were not clicked.
+func preferencePairs(c appengine.Context, clicks []Click) ([][]float64, error) {
+	byImp := make(map[int64]map[string]bool)
+	var impIDs []int64
+	for _, click := range clicks {
+		if byImp[click.Impression] == nil {
+			byImp[click.Impression] = make(map[string]bool)
+			impIDs = append(impIDs, click.Impression)
+		}
+		byImp[click.Impression][click.Package] = true
+	}
+	imps, err := getImpressions(c, impIDs)
+	if err != nil {
+		return nil, err
+	}
+	
+	var pairs [][]float64
+	for k, imp := range imps {
+		if imp == nil || imp.Sort != sortRelevance {
+			continue
+		}
+		clicked := byImp[impIDs[k]]
+		
+		groups := queryGroups(c, imp.Query)
+		docs := make([]DocInfo, len(imp.Packages))
+		fetchDocs(c, imp.Packages, docs)
+		feats := make([][]float64, len(docs))
+		qw := qualityWeights(c)
+		for i := range docs {
+			if docs[i].Package == "" {
+				continue
+			}
+			if docs[i].StaticScore < 1 {
+				docs[i].updateStaticScore(qw)
+			}
+			feats[i] = rankFeatures(&docs[i], groups)
+		}
+		
+		for i, pkg := range imp.Packages {
+			if !clicked[pkg] || feats[i] == nil {
+				continue
+			}
+			for j := 0; j < i; j++ {
+				if clicked[imp.Packages[j]] || feats[j] == nil {
+					continue
+				}
+				diff := make([]float64, featCount)
+				for f := range diff {
+					diff[f] = feats[i][f] - feats[j][f]
+				}
+				pairs = append(pairs, diff)
+			}
+		}
+	}
+	return pairs, nil
+}
+
+// trainRankModel learns a model from clicks, starting from the default one.
+// It returns nil if there are no preference pairs.
+func trainRankModel(c appengine.Context, clicks []Click) (*RankModel, error) {
+	pairs, err := preferencePairs(c, clicks)
+	if err != nil {
+		return nil, err
+	}
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	
+	m := defaultRankModel()
+	w := m.Weights
+	for epoch := 0; epoch < trainEpochs; epoch++ {
+		for _, diff := range pairs {
+			// gradient of log(1 + exp(-w.diff))
+			g := 1 / (1 + math.Exp(m.score(diff)))
+			for f := range w {
+				w[f] += trainLearningRate * (g*diff[f] - trainL2*w[f])
+			}
+		}
+	}
+	
+	m.Trained = time.Now()
+	m.Pairs = len(pairs)
+	return m, nil
+}
@@ -0,0 +1,148 @@
+package gocode
+
+import (
+	"appengine"
+	"sort"
+	"strings"
+)
+
+// An Explanation breaks the score of a result down into the rank features of
+// the model, the matches of the query terms behind MatchScore, and the parts of
+// StaticScore. It is shown on ?explain=1 of /search and /api/search.
+type Explanation struct {
+	Score float64
+	// "learned" or "default"
+	Model    string
+	Features []FeatureExplain
+	Match    MatchExplain
+	Static   StaticExplain
+}
+
+// FeatureExplain is the contribution, Value * Weight, of a rank feature.
+type FeatureExplain struct {
+	Name   string
+	Value  float64
+	Weight float64
+	Score  float64
+}
+
+// MatchExplain is the parts of MatchScore, one per query term.
+type MatchExplain struct {
+	Terms []TermExplain
+	Total float64
+}
+
+// TermExplain is how a query term matches the fields of a document. A match
+// is 1 if the term matches, SynonymWeight if only a synonym of it does.
+type TermExplain struct {
+	Term     string
+	Synonyms []string `json:",omitempty"`
+	Name     float64
+	Synopsis float64
+	Package  float64
+	Score    float64
+}
+
+// StaticExplain is the parts of StaticScore, computed from the current
+// document, so Total may differ from a StaticScore computed before.
+type StaticExplain struct {
+	Base      float64
+	Importers []ImporterExplain
+	Bonuses   []Bonus
+	Total     float64
+}
+
+// ImporterExplain is the contribution of an importer, the smaller of ByProject
+// and ByAuthor. Importers of the same project, or of the same author, share
+// 1/sqrt(n) each, and are further discounted by 0.1, or 0.5, if the project, or
+// the author, is that of the document.
+type ImporterExplain struct {
+	Package      string
+	ProjectCount int
+	SameProject  bool
+	ByProject    float64
+	AuthorCount  int
+	SameAuthor   bool
+	ByAuthor     float64
+	Score        float64
+}
+
+// Bonus is a part of StaticScore other than importers.
+type Bonus struct {
+	Reason string
+	Score  float64
+}
+
+// queryGroups returns the expanded query groups of the terms of q.
+func queryGroups(c appengine.Context, q string) []QueryGroup {
+	text, _ := parseFacetQuery(q)
+	return expandQuery(c, analyzeTokens(queryAnalyzer, nil, text))
+}
+
+// explainMatch returns the parts of calcMatchScore(doc, groups).
+func explainMatch(doc *DocInfo, groups []QueryGroup) MatchExplain {
+	if len(groups) == 0 {
+		return MatchExplain{Total: 1}
+	}
+	
+	var ex MatchExplain
+	names, synopses, pkgs := groupMatches(doc, groups)
+	for i, g := range groups {
+		t := TermExplain{
+			Term:     g.Token,
+			Name:     names[i],
+			Synopsis: synopses[i],
+			Package:  pkgs[i],
+		}
+		for _, syn := range g.Synonyms {
+			terms := syn.Elements()
+			sort.Strings(terms)
+			t.Synonyms = append(t.Synonyms, strings.Join(terms, " "))
+		}
+		t.Score = matchBaseWeight + synopsisMatchWeight*t.Synopsis +
+			nameMatchWeight*t.Name + packageMatchWeight*t.Package
+		ex.Terms = append(ex.Terms, t)
+		ex.Total += t.Score
+	}
+	return ex
+}
+
+// explainHits sets the explanations of hits, results of q ranked by the active
+// model.
+func explainHits(c appengine.Context, q string, hits []*SearchHit) {
+	groups := queryGroups(c, q)
+	m, qw := activeRankModel(c), qualityWeights(c)
+	for _, hit := range hits {
+		hit.Explain = explainDoc(hit.Doc, groups, m, qw)
+	}
+}
+
+// explainDoc explains the Score of doc ranked by m for groups, with quality
+// weights qw.
+func explainDoc(doc *DocInfo, groups []QueryGroup, m *RankModel,
+		qw *QualityWeights) *Explanation {
+	ex := &Explanation{
+		Score: doc.Score,
+		Model: "default",
+		Match: explainMatch(doc, groups),
+	}
+	if m.Active {
+		ex.Model = rankModelID
+	}
+	
+	f := rankFeatures(doc, groups)
+	for i, w := range m.Weights {
+		if w == 0 {
+			continue
+		}
+		ex.Features = append(ex.Features, FeatureExplain{
+			Name:   rankFeatureNames[i],
+			Value:  f[i],
+			Weight: w,
+			Score:  w * f[i],
+		})
+	}
+	
+	staticRank(doc, qw, &ex.Static)
+	return ex
+}
@@ -0,0 +1,278 @@
+package gocode
+
+import (
+	"github.com/daviddengcn/go-villa"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Facet filters are written in the query as name:value, e.g.
+//
+//     websocket host:github.com stars:100-999
+//
+// A document matches if it matches all of the filters. Facets are counted
+// over the summaries of all the matched documents, not only the current page.
+const (
+	facetHost    = "host"
+	facetAuthor  = "author"
+	facetLicense = "license"
+	facetStars   = "stars"
+	facetUpdated = "updated"
+	
+	// the value of documents without a known license
+	unknownLicense = "unknown"
+	
+	// the maximum number of values shown of a facet
+	maxFacetValues = 8
+)
+
+var facetNames = []string{
+	facetHost, facetAuthor, facetLicense, facetStars, facetUpdated,
+}
+
+// bucket values of the ordered facets
+var (
+	starBuckets    = []string{"0", "1-9", "10-99", "100-999", "1000+"}
+	updatedBuckets = []string{"week", "month", "year", "older"}
+)
+
+type FacetValue struct {
+	Value    string
+	Count    int
+	Selected bool
+	// the query with this value added, or removed if selected
+	Query string
+}
+
+type Facet struct {
+	Name   string
+	Values []FacetValue
+}
+
+// FacetFilter is a name:value filter in the query.
+type FacetFilter struct {
+	Name, Value string
+}
+
+func isFacetName(name string) bool {
+	for _, n := range facetNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseFacetQuery splits q into the text to search and the facet filters.
+func parseFacetQuery(q string) (text string, filters []FacetFilter) {
+	var words []string
+	for _, w := range strings.Fields(q) {
+		p := strings.Index(w, ":")
+		if p > 0 && p+1 < len(w) && isFacetName(strings.ToLower(w[:p])) {
+			filters = append(filters, FacetFilter{
+				Name:  strings.ToLower(w[:p]),
+				Value: w[p+1:],
+			})
+			continue
+		}
+		words = append(words, w)
+	}
+	return strings.Join(words, " "), filters
+}
+
+func hostOfPackage(pkg string) string {
+	if p := strings.Index(pkg, "/"); p >= 0 {
+		return pkg[:p]
+	}
+	return pkg
+}
+
+func starBucket(stars int) string {
+	switch {
+	case stars <= 0:
+		return "0"
+	case stars < 10:
+		return "1-9"
+	case stars < 100:
+		return "10-99"
+	case stars < 1000:
+		return "100-999"
+	}
+	return "1000+"
+}
+
+func updatedBucket(t, now time.Time) string {
+	switch age := now.Sub(t); {
+	case age < 7*24*time.Hour:
+		return "week"
+	case age < 31*24*time.Hour:
+		return "month"
+	case age < 366*24*time.Hour:
+		return "year"
+	}
+	return "older"
+}
+
+// facetValueOf returns the value of facet name of row.
+func facetValueOf(row *DocRow, name string, now time.Time) string {
+	switch name {
+	case facetHost:
+		return hostOfPackage(row.Package)
+	case facetAuthor:
+		return authorOfPackage(row.Package)
+	case facetLicense:
+		if row.License == "" {
+			return unknownLicense
+		}
+		return row.License
+	case facetStars:
+		return starBucket(row.StarCount)
+	case facetUpdated:
+		return updatedBucket(row.LastUpdated, now)
+	}
+	return ""
+}
+
+// matchFacets returns true if row matches all filters. The value of a filter
+// may list alternatives separated by commas, e.g. license:MIT,Apache-2.0.
+func matchFacets(row *DocRow, filters []FacetFilter, now time.Time) bool {
+	for _, f := range filters {
+		if !matchValues(facetValueOf(row, f.Name, now), f.Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchValues returns true if v equals any of the comma separated values.
+func matchValues(v, values string) bool {
+	for _, value := range strings.Split(values, ",") {
+		if strings.EqualFold(v, strings.TrimSpace(value)) {
+			return true
+		}
+	}
+	return false
+}
+
+func filterFacets(rows []*DocRow, filters []FacetFilter) []*DocRow {
+	if len(filters) == 0 {
+		return rows
+	}
+	now := time.Now()
+	res := rows[:0]
+	for _, row := range rows {
+		if matchFacets(row, filters, now) {
+			res = append(res, row)
+		}
+	}
+	return res
+}
+
+// facetQuery returns q with filter name:value toggled.
+func facetQuery(q, name, value string) string {
+	var words []string
+	removed := false
+	for _, w := range strings.Fields(q) {
+		if strings.EqualFold(w, name+":"+value) {
+			removed = true
+			continue
+		}
+		words = append(words, w)
+	}
+	if !removed {
+		words = append(words, name+":"+value)
+	}
+	return strings.Join(words, " ")
+}
+
+// countFacets aggregates the facets of rows. q is the query, with the filters,
+// the values link to.
+func countFacets(rows []*DocRow, q string, filters []FacetFilter) []Facet {
+	now := time.Now()
+	counts := make(map[string]map[string]int)
+	for _, name := range facetNames {
+		counts[name] = make(map[string]int)
+	}
+	for _, row := range rows {
+		for _, name := range facetNames {
+			counts[name][facetValueOf(row, name, now)]++
+		}
+	}
+	// selected values are always shown
+	for _, f := range filters {
+		found := false
+		for v := range counts[f.Name] {
+			found = found || strings.EqualFold(v, f.Value)
+		}
+		if !found {
+			counts[f.Name][f.Value] = 0
+		}
+	}
+	
+	facets := make([]Facet, 0, len(facetNames))
+	for _, name := range facetNames {
+		var values []FacetValue
+		for v, cnt := range counts[name] {
+			selected := false
+			for _, f := range filters {
+				if f.Name == name && strings.EqualFold(f.Value, v) {
+					selected = true
+				}
+			}
+			values = append(values, FacetValue{
+				Value:    v,
+				Count:    cnt,
+				Selected: selected,
+				Query:    facetQuery(q, name, v),
+			})
+		}
+		
+		switch name {
+		case facetStars:
+			sortFacetBuckets(values, starBuckets)
+		case facetUpdated:
+			sortFacetBuckets(values, updatedBuckets)
+		default:
+			sort.Sort(byFacetCount(values))
+			if len(values) > maxFacetValues {
+				values = values[:maxFacetValues]
+			}
+		}
+		if len(values) > 0 {
+			facets = append(facets, Facet{Name: name, Values: values})
+		}
+	}
+	return facets
+}
+
+type byFacetCount []FacetValue
+
+func (vs byFacetCount) Len() int      { return len(vs) }
+func (vs byFacetCount) Swap(i, j int) { vs[i], vs[j] = vs[j], vs[i] }
+func (vs byFacetCount) Less(i, j int) bool {
+	if vs[i].Selected != vs[j].Selected {
+		return vs[i].Selected
+	}
+	if vs[i].Count != vs[j].Count {
+		return vs[i].Count > vs[j].Count
+	}
+	return vs[i].Value < vs[j].Value
+}
+
+// sortFacetBuckets sorts values in the order of buckets.
+func sortFacetBuckets(values []FacetValue, buckets []string) {
+	rank := func(v string) int {
+		for i, b := range buckets {
+			if b == v {
+				return i
+			}
+		}
+		return len(buckets)
+	}
+	villa.SortF(len(values), func(i, j int) bool {
+		return rank(values[i].Value) < rank(values[j].Value)
+	}, func(i, j int) {
+		values[i], values[j] = values[j], values[i]
+	})
+}
@@ -0,0 +1,109 @@
+package gocode
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+)
+
+const (
+	// the least length of the normalized docs of a package to fingerprint it,
+	// so that unrelated packages with empty or boilerplate docs, e.g. util,
+	// are not taken as copies of each other
+	minFingerprintDocs = 64
+	// the most ForkOf links followed to the original package
+	maxForkChain = 5
+)
+
+// normFingerprintText lower-cases text and collapses white spaces so that
+// reformatted copies give the same fingerprint.
+func normFingerprintText(text string) string {
+	return strings.Join(strings.Fields(strings.ToLower(text)), " ")
+}
+
+// docFingerprint returns a fingerprint of the contents of a package. Forks and
+// mirrors of a package usually have the same name, docs and imports, except
+// that imports of their own sub-packages are under a different root. Returns
+// "" if the docs are too short to tell copies.
+func docFingerprint(d *DocInfo) string {
+	docs := []string{normFingerprintText(d.Synopsis),
+		normFingerprintText(d.Description), normFingerprintText(d.ReadmeData)}
+	if len(strings.Join(docs, "")) < minFingerprintDocs {
+		return ""
+	}
+	
+	root := projectRootOfPackage(d.Package)
+	imports := make([]string, 0, len(d.Imports))
+	for _, imp := range d.Imports {
+		if strings.HasPrefix(imp, root+"/") {
+			imp = "~" + imp[len(root):]
+		}
+		imports = append(imports, imp)
+	}
+	sort.Strings(imports)
+	
+	h := fnv.New64a()
+	for _, s := range []string{d.Name, docs[0], docs[1], docs[2],
+			strings.Join(imports, " ")} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// ForkGroup is a package in search results with its forks and mirrors.
+type ForkGroup struct {
+	Canonical *DocRow
+	Forks     []*DocRow
+}
+
+// collapseForks groups near-duplicate packages in rows, keeping the order of
+// the first member of each group. Packages with the same fingerprint, or
+// forked from a package in rows, are in the same group. Packages without a
+// fingerprint are only grouped by ForkOf. The canonical package
+// is the first one which is not marked as a fork.
+func collapseForks(rows []*DocRow) []*ForkGroup {
+	byPkg := make(map[string]*DocRow, len(rows))
+	for _, row := range rows {
+		byPkg[row.Package] = row
+	}
+	
+	keyOf := func(row *DocRow) string {
+		for i := 0; row.ForkOf != "" && i < maxForkChain; i++ {
+			parent, ok := byPkg[row.ForkOf]
+			if !ok {
+				break
+			}
+			row = parent
+		}
+		
+		if row.Fingerprint == "" {
+			return "pkg:" + row.Package
+		}
+		return row.Fingerprint
+	}
+	
+	var groups []*ForkGroup
+	keyToGroup := make(map[string]*ForkGroup)
+	for _, row := range rows {
+		key := keyOf(row)
+		g, ok := keyToGroup[key]
+		if !ok {
+			g = &ForkGroup{Canonical: row}
+			keyToGroup[key] = g
+			groups = append(groups, g)
+			continue
+		}
+		
+		if g.Canonical.ForkOf != "" && row.ForkOf == "" {
+			// prefer the original one
+			g.Forks = append(g.Forks, g.Canonical)
+			g.Canonical = row
+		} else {
+			g.Forks = append(g.Forks, row)
+		}
+	}
+	
+	return groups
+}
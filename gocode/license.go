@@ -0,0 +1,221 @@
+package gocode
+
+import (
+	"appengine"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Licenses are detected from the license file, e.g. LICENSE or COPYING, sent
+// by the crawler. The text is normalized into lower-case words and matched
+// against the fingerprints of the known licenses. The copyleft licenses quote
+// and refer to each other, so they are told by their title, or by the notice
+// of a source file, at the head of the text. The permissive ones often have
+// no title and are told by phrases that all appear in their text.
+type licenseFingerprint struct {
+	ID string
+	// any of these at the head of the text
+	Head []string
+	// all of these anywhere in the text
+	Phrases []string
+}
+
+// the length of the normalized head of a license text searched for titles
+const licenseHeadLen = 1000
+
+var knownLicenses = []licenseFingerprint{
+	{"AGPL-3.0", []string{
+		"gnu affero general public license version 3 19 november 2007",
+		"gnu affero general public license as published by the free software foundation either version 3 of the license",
+	}, nil},
+	{"LGPL-3.0", []string{
+		"gnu lesser general public license version 3 29 june 2007",
+		"gnu lesser general public license as published by the free software foundation either version 3 of the license",
+	}, nil},
+	{"LGPL-2.1", []string{
+		"gnu lesser general public license version 2 1 february 1999",
+		"gnu lesser general public license as published by the free software foundation either version 2 1 of the license",
+	}, nil},
+	{"LGPL-2.0", []string{
+		"gnu library general public license version 2 june 1991",
+		"gnu library general public license as published by the free software foundation either version 2 of the license",
+	}, nil},
+	{"GPL-3.0", []string{
+		"gnu general public license version 3 29 june 2007",
+		"gnu general public license as published by the free software foundation either version 3 of the license",
+	}, nil},
+	{"GPL-2.0", []string{
+		"gnu general public license version 2 june 1991",
+		"gnu general public license as published by the free software foundation either version 2 of the license",
+	}, nil},
+	{"MPL-2.0", []string{
+		"mozilla public license version 2 0",
+		"subject to the terms of the mozilla public license v 2 0",
+	}, nil},
+	{"EPL-1.0", []string{
+		"eclipse public license v 1 0",
+		"eclipse public license version 1 0",
+	}, nil},
+	{"Apache-2.0", []string{
+		"apache license version 2 0 january 2004",
+		"licensed under the apache license version 2 0",
+	}, nil},
+	{"CC0-1.0", []string{"cc0 1 0 universal"}, nil},
+	{"WTFPL", []string{"do what the fuck you want to public license"}, nil},
+	{"Unlicense", []string{
+		"this is free and unencumbered software released into the public domain",
+	}, nil},
+	{"BSD-3-Clause", nil, []string{
+		"redistribution and use in source and binary forms",
+		"neither the name",
+	}},
+	{"BSD-2-Clause", nil, []string{
+		"redistribution and use in source and binary forms",
+		"this list of conditions and the following disclaimer",
+	}},
+	{"MIT", nil, []string{
+		"permission is hereby granted free of charge to any person obtaining a copy",
+	}},
+	{"ISC", nil, []string{
+		"permission to use copy modify and or distribute this software for any purpose",
+	}},
+	{"Zlib", nil, []string{
+		"altered source versions must be plainly marked as such",
+		"this notice may not be removed or altered from any source distribution",
+	}},
+}
+
+// normLicenseText returns the lower-case letters and digits of text, as words
+// separated by single spaces.
+func normLicenseText(text string) string {
+	return " " + strings.Join(strings.FieldsFunc(strings.ToLower(text),
+		func(r rune) bool {
+			return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9')
+		}), " ") + " "
+}
+
+// matches returns whether the normalized license text norm, with its head,
+// matches the fingerprint.
+func (l *licenseFingerprint) matches(head, norm string) bool {
+	for _, phrase := range l.Head {
+		if strings.Contains(head, " "+phrase+" ") {
+			return true
+		}
+	}
+	if len(l.Phrases) == 0 {
+		return false
+	}
+	for _, phrase := range l.Phrases {
+		if !strings.Contains(norm, " "+phrase+" ") {
+			return false
+		}
+	}
+	return true
+}
+
+// detectLicense returns the SPDX identifier of the license text, "" if unknown.
+func detectLicense(text string) string {
+	norm := normLicenseText(text)
+	head := norm
+	if len(head) > licenseHeadLen {
+		head = head[:licenseHeadLen]
+	}
+	for i := range knownLicenses {
+		if knownLicenses[i].matches(head, norm) {
+			return knownLicenses[i].ID
+		}
+	}
+	return ""
+}
+
+// packageLicense returns the license of the crawled package p: the one of its
+// license file if detected, or else the one of the root package of the
+// repository.
+func packageLicense(c appengine.Context, p *CrawledPackage) string {
+	if l := detectLicense(p.LicenseData); l != "" {
+		return l
+	}
+
+	root := projectRootOfPackage(p.ImportPath)
+	if root == p.ImportPath {
+		return ""
+	}
+	var d DocInfo
+	if err, _ := NewCachedDocDB(c, kindDocDB).Get(root, &d); err != nil {
+		c.Errorf("Get(%s, %s) failed: %v", kindDocDB, root, err)
+	}
+	return d.License
+}
+
+// the cookie of the allowed licenses preference
+const licensesCookie = "licenses"
+
+// allowedLicenses returns the allowed licenses preference of r, nil for all.
+func allowedLicenses(r *http.Request) []string {
+	cookie, err := r.Cookie(licensesCookie)
+	if err != nil {
+		return nil
+	}
+	v, _ := url.QueryUnescape(cookie.Value)
+	return splitLicenses(v)
+}
+
+// splitLicenses returns the comma separated licenses in s.
+func splitLicenses(s string) []string {
+	var res []string
+	for _, l := range strings.Split(s, ",") {
+		if l = strings.TrimSpace(l); l != "" {
+			res = append(res, l)
+		}
+	}
+	return res
+}
+
+// LicenseChoice is a license on the preferences page.
+type LicenseChoice struct {
+	ID      string
+	Allowed bool
+}
+
+// pagePrefs shows and saves the preferences, for now the allowed licenses of
+// search results.
+func pagePrefs(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		r.ParseForm()
+		v := strings.Join(r.Form["license"], ",")
+		cookie := &http.Cookie{
+			Name:    licensesCookie,
+			Value:   url.QueryEscape(v),
+			Path:    "/",
+			Expires: time.Now().Add(365 * 24 * time.Hour),
+		}
+		if v == "" {
+			cookie.Expires, cookie.MaxAge = time.Unix(0, 0), -1
+		}
+		http.SetCookie(w, cookie)
+		http.Redirect(w, r, "/prefs", http.StatusSeeOther)
+		return
+	}
+
+	allowed := make(map[string]bool)
+	for _, l := range allowedLicenses(r) {
+		allowed[strings.ToLower(l)] = true
+	}
+	var choices []LicenseChoice
+	for _, l := range knownLicenses {
+		choices = append(choices, LicenseChoice{l.ID, allowed[strings.ToLower(l.ID)]})
+	}
+	choices = append(choices, LicenseChoice{unknownLicense, allowed[unknownLicense]})
+
+	if err := templates.ExecuteTemplate(w, "prefs.html", struct {
+		Licenses []LicenseChoice
+		All      bool
+	}{
+		Licenses: choices,
+		All:      len(allowed) == 0,
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,62 @@
+package gocode
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDetectLicenseTexts(t *testing.T) {
+	for _, l := range knownLicenses {
+		fn := filepath.Join("testdata", "licenses", l.ID+".txt")
+		text, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Errorf("ReadFile(%s) failed: %v", fn, err)
+			continue
+		}
+		if id := detectLicense(string(text)); id != l.ID {
+			t.Errorf("detectLicense(%s) = %q, want %q", fn, id, l.ID)
+		}
+	}
+}
+
+func TestDetectLicenseNotices(t *testing.T) {
+	for _, c := range []struct {
+		text string
+		id   string
+	}{
+		{`Copyright (C) 2013  Jane Doe
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.`, "GPL-3.0"},
+		{`Copyright (C) 2013  Jane Doe
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.`, "AGPL-3.0"},
+		{`This library is free software; you can redistribute it and/or
+modify it under the terms of the GNU Lesser General Public
+License as published by the Free Software Foundation; either
+version 2.1 of the License, or (at your option) any later version.`, "LGPL-2.1"},
+		{`Copyright 2013 Jane Doe
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.`, "Apache-2.0"},
+		{`This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at http://mozilla.org/MPL/2.0/.`, "MPL-2.0"},
+		// a license only referring to the GNU licenses deep in its text
+		{"Some License\n\n" + strings.Repeat("terms ", licenseHeadLen) +
+			"GNU General Public License version 3 29 June 2007", ""},
+		{"", ""},
+		{"All rights reserved.", ""},
+	} {
+		if id := detectLicense(c.text); id != c.id {
+			t.Errorf("detectLicense(%.40q) = %q, want %q", c.text, id, c.id)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package gocode
+
+import (
+	"appengine"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A RankModel scores a document by a linear combination of its ranking
+// features. The default model has a weight of 1 on featScore, the hand-tuned
+// score, so it ranks exactly as before. A model learned from clicks is stored
+// in kindRankModel and used once activated on /ltr.
+const (
+	featScore     = iota // (StaticScore - 0.9) * MatchScore
+	featStatic           // StaticScore - 0.9
+	featMatch            // MatchScore
+	featName             // fraction of query terms matching the name
+	featSynopsis         // fraction of query terms matching the synopsis
+	featPackage          // fraction of query terms matching the import path
+	featStars            // log(1 + stars)
+	featImporters        // log(1 + importers)
+	featCount
+)
+
+var rankFeatureNames = []string{
+	"score", "static", "match", "name", "synopsis", "package", "stars",
+	"importers",
+}
+
+const (
+	rankModelID = "learned"
+	// the active model is reloaded after this interval
+	rankModelReloadInterval = time.Minute
+	// clicks of this period are used for training and evaluation
+	clickWindow = 30 * 24 * time.Hour
+)
+
+type RankModel struct {
+	Names   []string  `datastore:",noindex"`
+	Weights []float64 `datastore:",noindex"`
+	// true if the model is used for ranking
+	Active  bool      `datastore:",noindex"`
+	Trained time.Time `datastore:",noindex"`
+	// the number of preference pairs the model was trained with
+	Pairs int `datastore:",noindex"`
+}
+
+// defaultRankModel returns the model of the hand-tuned score.
+func defaultRankModel() *RankModel {
+	w := make([]float64, featCount)
+	w[featScore] = 1
+	return &RankModel{Names: rankFeatureNames, Weights: w}
+}
+
+// valid returns true if the weights are of the current features.
+func (m *RankModel) valid() bool {
+	if len(m.Names) != featCount || len(m.Weights) != featCount {
+		return false
+	}
+	for i, name := range m.Names {
+		if name != rankFeatureNames[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func logCount(n int) float64 {
+	if n < 0 {
+		n = 0
+	}
+	return math.Log(1 + float64(n))
+}
+
+// rankFeatures returns the features of doc for the query groups. doc's
+// StaticScore must be updated.
+func rankFeatures(doc *DocInfo, groups []QueryGroup) []float64 {
+	f := make([]float64, featCount)
+	f[featStatic] = doc.StaticScore - 0.9
+	f[featMatch] = calcMatchScore(doc, groups)
+	f[featScore] = f[featStatic] * f[featMatch]
+	f[featName], f[featSynopsis], f[featPackage] = matchFeatures(doc, groups)
+	f[featStars] = logCount(doc.StarCount)
+	f[featImporters] = logCount(len(doc.ImportedPkgs))
+	return f
+}
+
+func (m *RankModel) score(f []float64) float64 {
+	s := 0.
+	for i, w := range m.Weights {
+		s += w * f[i]
+	}
+	return s
+}
+
+// scoreDoc sets the MatchScore and Score of doc. doc's StaticScore must be
+// updated.
+func (m *RankModel) scoreDoc(doc *DocInfo, groups []QueryGroup) {
+	f := rankFeatures(doc, groups)
+	doc.MatchScore = f[featMatch]
+	doc.Score = m.score(f)
+}
+
+// bound returns the upper bound of the scores of the document of row for n
+// query groups. Features in the row are exact, the others are bounded by
+// their ranges.
+func (m *RankModel) bound(row *DocRow, n int) float64 {
+	return m.boundOf(row.StaticScore, row.StarCount, row.ImportedCount, n)
+}
+
+// boundOf is bound of a row with a static score, stars and importers.
+func (m *RankModel) boundOf(staticScore float64, stars, importers, n int) float64 {
+	lo, hi := make([]float64, featCount), make([]float64, featCount)
+	static := staticScore - 0.9
+	lo[featStatic], hi[featStatic] = static, static
+	if n == 0 {
+		lo[featMatch], hi[featMatch] = 1, 1
+	} else {
+		lo[featMatch] = matchBaseWeight * float64(n)
+		hi[featMatch] = maxMatchScore(make([]QueryGroup, n))
+	}
+	lo[featScore], hi[featScore] = static*lo[featMatch], static*hi[featMatch]
+	if static < 0 {
+		lo[featScore], hi[featScore] = hi[featScore], lo[featScore]
+	}
+	for _, i := range []int{featName, featSynopsis, featPackage} {
+		lo[i], hi[i] = 0, 1
+	}
+	lo[featStars] = logCount(stars)
+	hi[featStars] = lo[featStars]
+	lo[featImporters] = logCount(importers)
+	hi[featImporters] = lo[featImporters]
+	
+	s := 0.
+	for i, w := range m.Weights {
+		if w >= 0 {
+			s += w * hi[i]
+		} else {
+			s += w * lo[i]
+		}
+	}
+	return s
+}
+
+var rankModelCache struct {
+	sync.Mutex
+	model    *RankModel
+	loadTime time.Time
+}
+
+// loadRankModel returns the stored model, nil if none.
+func loadRankModel(c appengine.Context) *RankModel {
+	var m RankModel
+	err, exists := NewDocDB(c, kindRankModel).Get(rankModelID, &m)
+	if err != nil {
+		c.Errorf("Get(%s, %s) failed: %v", kindRankModel, rankModelID, err)
+		return nil
+	}
+	if !exists {
+		return nil
+	}
+	return &m
+}
+
+func saveRankModel(c appengine.Context, m *RankModel) error {
+	if err := NewDocDB(c, kindRankModel).Put(rankModelID, m); err != nil {
+		return err
+	}
+	
+	rankModelCache.Lock()
+	rankModelCache.loadTime = time.Time{}
+	rankModelCache.Unlock()
+	// rankings change
+	bumpIndexGeneration(c)
+	return nil
+}
+
+// activeRankModel returns the model used for ranking.
+func activeRankModel(c appengine.Context) *RankModel {
+	rankModelCache.Lock()
+	defer rankModelCache.Unlock()
+	
+	if rankModelCache.model != nil &&
+			time.Now().Sub(rankModelCache.loadTime) < rankModelReloadInterval {
+		return rankModelCache.model
+	}
+	
+	m := loadRankModel(c)
+	if m == nil || !m.Active || !m.valid() {
+		if m != nil && m.Active {
+			c.Errorf("Stored rank model of features %v ignored", m.Names)
+		}
+		m = defaultRankModel()
+	}
+	rankModelCache.model, rankModelCache.loadTime = m, time.Now()
+	return m
+}
+
+// LtrEval is the metrics of the default and the learned models on a set of
+// judgments.
+type LtrEval struct {
+	Name    string
+	Default EvalResult
+	Learned EvalResult
+}
+
+// pageLtr shows the rank models and evaluates them on ?eval=1. Posting
+// action=train learns a new, inactive, model from recent clicks; activate and
+// deactivate switch ranking to and from the learned model.
+func pageLtr(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if r.Method == "POST" {
+		var err error
+		switch r.FormValue("action") {
+		case "train":
+			var clicks []Click
+			clicks, err = recentClicks(c, time.Now().Add(-clickWindow))
+			if err != nil {
+				break
+			}
+			var m *RankModel
+			m, err = trainRankModel(c, clicks)
+			if err == nil && m == nil {
+				http.Error(w, "No preference pairs in recent clicks",
+					http.StatusBadRequest)
+				return
+			}
+			if err == nil {
+				err = saveRankModel(c, m)
+			}
+		case "activate", "deactivate":
+			m := loadRankModel(c)
+			if m == nil || !m.valid() {
+				http.Error(w, "No valid learned model", http.StatusBadRequest)
+				return
+			}
+			m.Active = r.FormValue("action") == "activate"
+			err = saveRankModel(c, m)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/ltr", http.StatusSeeOther)
+		return
+	}
+	
+	learned := loadRankModel(c)
+	if learned != nil && !learned.valid() {
+		learned = nil
+	}
+	
+	var evals []LtrEval
+	if r.FormValue("eval") != "" {
+		clicks, err := recentClicks(c, time.Now().Add(-clickWindow))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, set := range []struct {
+			name string
+			js   Judgments
+		}{
+			{"Clicks of the last 30 days", clickJudgments(clicks)},
+			{judgmentsFile, readJudgmentsFile(c)},
+		} {
+			ev := LtrEval{Name: set.name}
+			ev.Default, err = evaluateModel(c, defaultRankModel(), set.js)
+			if err == nil && learned != nil {
+				ev.Learned, err = evaluateModel(c, learned, set.js)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			evals = append(evals, ev)
+		}
+	}
+	
+	err := templates.ExecuteTemplate(w, "ltr.html", struct {
+		Features []string
+		Default  *RankModel
+		Learned  *RankModel
+		Evals    []LtrEval
+	}{
+		Features: rankFeatureNames,
+		Default:  defaultRankModel(),
+		Learned:  learned,
+		Evals:    evals,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"html/template"
 	"log"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 	godoc "go/doc"
@@ -25,8 +26,25 @@ func init() {
 	
 	http.HandleFunc("/crawler", pageCrawler)
 	http.HandleFunc("/db", pageDb)
+	http.HandleFunc("/synonyms", pageSynonyms)
 
 	http.HandleFunc("/index", pageIndex)
+	http.HandleFunc("/reindex", pageReindex)
+	http.HandleFunc("/spell", pageSpell)
+	http.HandleFunc("/rescore", pageRescore)
+	
+	http.HandleFunc("/api/search", apiSearch)
+	http.HandleFunc("/api/author", apiAuthor)
+	http.HandleFunc("/author", pageAuthor)
+	http.HandleFunc("/project", pageProject)
+	http.HandleFunc("/suggest", pageSuggest)
+	http.HandleFunc("/click", pageClick)
+	http.HandleFunc("/ltr", pageLtr)
+	http.HandleFunc("/quality", pageQuality)
+	http.HandleFunc("/crawlersettings", pageCrawlerSettings)
+	http.HandleFunc("/prefs", pagePrefs)
+	http.HandleFunc("/advisory", pageAdvisory)
+	http.HandleFunc("/advisories", pageAdvisories)
 	
 	gcc.Register(new(CrawlerServer))
 
@@ -52,6 +70,12 @@ type SubProjectInfo struct {
 	Info       string
 }
 
+type ForkInfo struct {
+	MarkedPackage template.HTML
+	Package       string
+	StarCount     int
+}
+
 type ShowDocInfo struct {
 	*DocInfo
 	Index         int
@@ -59,12 +83,16 @@ type ShowDocInfo struct {
 	MarkedName    template.HTML
 	MarkedPackage template.HTML
 	Subs          []SubProjectInfo
+	Forks         []ForkInfo
+	Explain       *Explanation
 }
 
 type ShowResults struct {
 	TotalResults int
 	TotalEntries int
 	Folded       int
+	Forks        int
+	Partial      bool
 	Docs         []ShowDocInfo
 }
 
@@ -75,7 +103,8 @@ func markWord(word []byte) []byte {
 	return buf
 }
 
-func markText(text string, tokens villa.StrSet,
+// markText marks the tokens of text with any term, analyzed by a, in tokens.
+func markText(text string, a Analyzer, tokens villa.StrSet,
 		markFunc func([]byte) []byte) template.HTML {
 	if len(text) == 0 {
 		return ""
@@ -83,15 +112,26 @@ func markText(text string, tokens villa.StrSet,
 	
 	var outBuf villa.ByteSlice
 	
-	index.MarkText([]byte(text), CheckRuneType, func(token []byte) bool {
+	index.MarkText([]byte(text), a.Tokenizer(), func(token []byte) bool {
 		// needMark
-		return tokens.In(normWord(string(token)))
+		needMark := false
+		a.MarkToken(string(token), tokens, func(_ string, marked bool) {
+			needMark = needMark || marked
+		})
+		return needMark
 	}, func(text []byte) error {
 		// output
 		template.HTMLEscape(&outBuf, text)
 		return nil
 	}, func(token []byte) error {
-		outBuf.Write(markFunc(token))
+		// only the matched segments of a token are marked
+		a.MarkToken(string(token), tokens, func(segment string, marked bool) {
+			if marked {
+				outBuf.Write(markFunc([]byte(segment)))
+			} else {
+				template.HTMLEscape(&outBuf, []byte(segment))
+			}
+		})
 		return nil
 	})
 	
@@ -106,69 +146,77 @@ func (r Range) In(idx int) bool {
 	return idx >= r.start && idx < r.start + r.count
 }
 
-func showSearchResults(results *SearchResult, tokens villa.StrSet,
-	r Range) *ShowResults {
-	docs := make([]ShowDocInfo, 0, len(results.Docs))
-
-	projToIdx := make(map[string]int)
-	folded := 0
-
-	cnt := 0
-mainLoop:
-	for _, d := range results.Docs {
+func showSearchResults(c appengine.Context, results *SearchResult,
+	tokens villa.StrSet, r Range) *ShowResults {
+	var hits []*SearchHit
+	if r.start < len(results.Hits) {
+		hits = results.Hits[r.start:]
+	}
+	if len(hits) > r.count {
+		hits = hits[:r.count]
+	}
+	
+	// only synopses of the sub-packages on this page are fetched
+	var subIds []string
+	for _, hit := range hits {
+		for _, sub := range hit.Subs {
+			subIds = append(subIds, sub.Package)
+		}
+	}
+	subDocs := make([]DocInfo, len(subIds))
+	fetchDocs(c, subIds, subDocs)
+	synopses := make(map[string]string, len(subIds))
+	for i := range subDocs {
+		synopses[subIds[i]] = subDocs[i].Synopsis
+	}
+	
+	docs := make([]ShowDocInfo, 0, len(hits))
+	for i, hit := range hits {
+		d := hit.Doc
 		if d.Name == "main" {
 			d.Name = "main - " + projectOfPackage(d.Package)
 		}
-
-		parts := strings.Split(d.Package, "/")
-		if len(parts) > 2 {
-			for i := len(parts) - 1; i >= 2; i-- {
-				pkg := strings.Join(parts[:i], "/")
-				if idx, ok := projToIdx[pkg]; ok {
-					markedName := markText(d.Name, tokens, markWord)
-					if r.In(idx) {
-						docsIdx := idx - r.start
-						docs[docsIdx].Subs = append(docs[docsIdx].Subs,
-							SubProjectInfo{
-								MarkedName: markedName,
-								Package:    d.Package,
-								SubPath:    "/" + strings.Join(parts[i:], "/"),
-								Info:       d.Synopsis,
-							})
-					}
-					folded++
-					continue mainLoop
-				}
-			}
+		if d.StarCount < 0 {
+			d.StarCount = 0
 		}
 		
-//		if len(docs) >= 1000 {
-//			continue
-//		}
-
-		projToIdx[d.Package] = cnt
-		if r.In(cnt) {
-			markedName := markText(d.Name, tokens, markWord)
-			raw := selectSnippets(d.Description+"\n"+d.ReadmeData, tokens, 300)
-	
-			if d.StarCount < 0 {
-				d.StarCount = 0
-			}
-			docs = append(docs, ShowDocInfo{
-				DocInfo:       d,
-				Index:         cnt + 1,
-				MarkedName:    markedName,
-				Summary:       markText(raw, tokens, markWord),
-				MarkedPackage: markText(d.Package, tokens, markWord),
+		var subs []SubProjectInfo
+		for _, sub := range hit.Subs {
+			subs = append(subs, SubProjectInfo{
+				MarkedName: markText(sub.Name, nameAnalyzer, tokens, markWord),
+				Package:    sub.Package,
+				SubPath:    sub.Package[len(d.Package):],
+				Info:       synopses[sub.Package],
+			})
+		}
+		var forkInfos []ForkInfo
+		for _, f := range hit.Forks {
+			forkInfos = append(forkInfos, ForkInfo{
+				MarkedPackage: markText(f.Package, packageAnalyzer, tokens, markWord),
+				Package:       f.Package,
+				StarCount:     f.StarCount,
 			})
 		}
-		cnt ++
+		
+		raw := selectSnippets(d.Description+"\n"+d.ReadmeData, tokens, 300)
+		docs = append(docs, ShowDocInfo{
+			DocInfo:       d,
+			Index:         r.start + i + 1,
+			MarkedName:    markText(d.Name, nameAnalyzer, tokens, markWord),
+			Summary:       markText(raw, textAnalyzer, tokens, markWord),
+			MarkedPackage: markText(d.Package, packageAnalyzer, tokens, markWord),
+			Subs:          subs,
+			Forks:         forkInfos,
+			Explain:       hit.Explain,
+		})
 	}
 
 	return &ShowResults{
 		TotalResults: results.TotalResults,
-		TotalEntries: cnt,
-		Folded:       folded,
+		TotalEntries: results.TotalEntries,
+		Folded:       results.Folded,
+		Forks:        results.Forks,
+		Partial:      results.Partial,
 		Docs:         docs,
 	}
 }
@@ -178,7 +226,7 @@ const itemsPerPage = 10
 func pageSearch(w http.ResponseWriter, r *http.Request) {
 	// current page, 1-based
 	p, err := strconv.Atoi(r.FormValue("p"))
-	if err != nil {
+	if err != nil || p < 1 {
 		p = 1
 	}
 	
@@ -186,15 +234,32 @@ func pageSearch(w http.ResponseWriter, r *http.Request) {
 
 	c := appengine.NewContext(r)
 	q := strings.TrimSpace(r.FormValue("q"))
-	results, tokens, err := search(c, q)
+	opts := parseSearchOptions(r)
+	results, tokens, err := searchWithSuggestion(c, q, opts, p*itemsPerPage,
+		r.FormValue("nocorrect") == "")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if p == 1 && results.TotalResults > 0 {
+		countQuery(c, q)
+	}
+	explain := r.FormValue("explain") != ""
+	if start := (p - 1)*itemsPerPage; explain && start < len(results.Hits) {
+		explainHits(c, resultsQuery(q, results), results.Hits[start:])
+	}
 	
-	showResults := showSearchResults(results, tokens,
+	showResults := showSearchResults(c, results, tokens,
 						Range{(p - 1)*itemsPerPage, itemsPerPage})
+	var impID int64
+	if len(showResults.Docs) > 0 {
+		impID = logImpression(c, q, opts, p, showResults.Docs)
+	}
 	totalPages := (showResults.TotalEntries + itemsPerPage - 1) / itemsPerPage
+	if showResults.Partial {
+		// more entries are read for the next pages
+		totalPages++
+	}
 	c.Infof("totalPages: %d", totalPages)
 	var beforePages, afterPages []int
 	for i := 1; i <= totalPages; i ++ {
@@ -223,6 +288,13 @@ func pageSearch(w http.ResponseWriter, r *http.Request) {
 		NextPage    int
 		AfterPages  []int
 		BottomQ     bool
+		Suggestion  string
+		Corrected   bool
+		Facets      []Facet
+		Options     SearchOptions
+		// the id of the logged impression, 0 if not logged
+		ImpressionID int64
+		Explain      bool
 	}{
 		Q:           q,
 		Results:     showResults,
@@ -232,7 +304,13 @@ func pageSearch(w http.ResponseWriter, r *http.Request) {
 		CurrentPage: p,
 		NextPage:    nextPage,
 		AfterPages:  afterPages,
-		BottomQ:     len(results.Docs) >= 5,
+		BottomQ:     len(showResults.Docs) >= 5,
+		Suggestion:  results.Suggestion,
+		Corrected:   results.Corrected,
+		Facets:      results.Facets,
+		Options:     opts,
+		ImpressionID: impID,
+		Explain:      explain,
 	}
 	c.Infof("Search results ready")
 	err = templates.ExecuteTemplate(w, "search.html", data)
@@ -274,10 +352,20 @@ func pageView(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if !exists {
+			if to := resolveRedirect(c, id); to != id {
+				http.Redirect(w, r, "view?id="+template.URLQueryEscaper(to),
+					http.StatusMovedPermanently)
+				return
+			}
+			
 			fmt.Fprintf(w, `<html><body>No such entry!`)
 
 			ent, _ := findCrawlingEntry(c, kindCrawlerPackage, id)
-			if ent != nil {
+			if ent != nil && ent.Tombstone {
+				fmt.Fprintf(w, ` Removed after %d failures (%s), to be checked again at %s`,
+					ent.FailureCount, template.HTMLEscapeString(ent.LastFailure),
+					ent.ScheduleTime.Format("2006-01-02 15:04:05"))
+			} else if ent != nil {
 				fmt.Fprintf(w, ` Scheduled to be crawled at %s`,
 					ent.ScheduleTime.Format("2006-01-02 15:04:05"))
 			} else {
@@ -295,16 +383,33 @@ func pageView(w http.ResponseWriter, r *http.Request) {
 		var descHTML villa.ByteSlice
 		godoc.ToHTML(&descHTML, doc.Description, nil)
 		
+		// the README is expanded if the package has little doc
 		showReadme := len(doc.Description) < 10 && len(doc.ReadmeData) > 0
 
 		err = templates.ExecuteTemplate(w, "view.html", struct {
 			DocInfo
 			DescHTML template.HTML
 			ShowReadme bool
+			ReadmeHTML template.HTML
+			AuthorID   string
+			ProjectRoot string
+			// DocCoverage in percent
+			DocPercent int
+			AdvisoryRefs    []AdvisoryRef
+			FixedAdvisoryRefs []AdvisoryRef
+			AffectedImports []AffectedImport
 		}{
 			DocInfo:    doc,
 			DescHTML:   template.HTML(descHTML),
 			ShowReadme: showReadme,
+			ReadmeHTML: renderReadme(doc.ReadmeFn, doc.ReadmeData, doc.Package,
+				doc.ProjectURL),
+			AuthorID:   personOfPackage(doc.Package),
+			ProjectRoot: projectRootOfPackage(doc.Package),
+			DocPercent:  int(doc.DocCoverage*100 + 0.5),
+			AdvisoryRefs:    loadAdvisoryRefs(c, doc.Advisories),
+			FixedAdvisoryRefs: loadAdvisoryRefs(c, doc.FixedAdvisories),
+			AffectedImports: affectedImports(c, doc.Imports),
 		})
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -338,6 +443,32 @@ func pageDb(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func pageSynonyms(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if r.Method == "POST" {
+		err := saveSynonymsEntity(c, r.FormValue("synonyms"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	
+	err := templates.ExecuteTemplate(w, "synonyms.html", struct {
+		FileName string
+		File     string
+		Edited   string
+		Entries  int
+	}{
+		FileName: synonymsFile,
+		File:     readSynonymsFile(c),
+		Edited:   loadSynonymsEntity(c),
+		Entries:  len(synonyms(c)),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 func pageClear(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
 	log.Println("Clearing import:import ...")
@@ -360,38 +491,114 @@ func pageClear(w http.ResponseWriter, r *http.Request) {
 }
 
 func pageTry(w http.ResponseWriter, r *http.Request) {
-	tokens := appendTokens(nil, "justTellsMeWhy goes going lied lie lies chicks efg1234.43 中文字符")
+	tokens := appendTokens(nil, "justTellsMeWhy goes going lied lie lies chicks efg1234.43 café 中文字符")
 	fmt.Fprintf(w, "Tokens: %v", tokens.Elements())
 }
 
+func pageSpell(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	cnt := buildSpellDict(c, 9*time.Minute)
+	
+	fmt.Fprintf(w, "Spell: %d", cnt)
+}
+
+// pageRescore continues the sweep queueing documents with drifted static
+// scores, run by cron.
+func pageRescore(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	checked, queued := rescoreDocs(c, 9*time.Minute)
+	
+	fmt.Fprintf(w, "Rescore: %d checked, %d queued", checked, queued)
+}
+
+// pageReindex fills the summaries of index entries written before they were
+// added. Follow the link to continue. Searches project the summaries once done.
+func pageReindex(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	next, cnt, err := reindexDocs(c, r.FormValue("cursor"), 50*time.Second)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "Reindexed: %d", cnt)
+	if next != "" {
+		fmt.Fprintf(w, ` <a href="/reindex?cursor=%s">continue</a>`,
+			url.QueryEscape(next))
+	}
+}
+
 func pageIndex(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
 	cntIndex := indexFetchedDocs(c, 9*time.Minute)
 	cntUpdate := processToUpdate(c, 9*time.Minute)
+	cntSuggest := applySuggestUpdates(c)
+	cntQuery := flushQueryCounts(c)
+	cntAuthor := processAuthorsToUpdate(c, time.Minute)
 	
-	fmt.Fprintf(w, "Index: %d, Update: %d", cntIndex, cntUpdate)
+	fmt.Fprintf(w, "Index: %d, Update: %d, Suggest: %d, Query: %d, Author: %d",
+		cntIndex, cntUpdate, cntSuggest, cntQuery, cntAuthor)
 }
 
 type CrawlerServer struct{}
 
-func (cs *CrawlerServer) FetchPackageList(r *http.Request, l int) (pkgs []string) {
+// LeasePackageList leases at most l packages to the crawler. A lease is
+// acknowledged by PushCrawledPackage or ReportPackageFailure with its LeaseID,
+// and expires after CrawlLeaseTimeout otherwise.
+func (cs *CrawlerServer) LeasePackageList(r *http.Request, l int) (pkgs []LeasedEntry) {
 	c := appengine.NewContext(r)
 	return listCrawlEntries(c, kindCrawlerPackage, l)
 }
 
-func (cs *CrawlerServer) FetchPersonList(r *http.Request, l int) (ids []string) {
+// LeasePersonList leases at most l persons to the crawler. A lease is
+// acknowledged by PushPerson.
+func (cs *CrawlerServer) LeasePersonList(r *http.Request, l int) (ids []LeasedEntry) {
 	c := appengine.NewContext(r)
 	return listCrawlEntries(c, kindCrawlerPerson, l)
 }
 
+// FetchPackageList is LeasePackageList returning the packages only, for
+// crawlers not aware of leases.
+func (cs *CrawlerServer) FetchPackageList(r *http.Request, l int) (pkgs []string) {
+	c := appengine.NewContext(r)
+	return leasedIDs(listCrawlEntries(c, kindCrawlerPackage, l))
+}
+
+// FetchPersonList is LeasePersonList returning the persons only.
+func (cs *CrawlerServer) FetchPersonList(r *http.Request, l int) (ids []string) {
+	c := appengine.NewContext(r)
+	return leasedIDs(listCrawlEntries(c, kindCrawlerPerson, l))
+}
+
+// PushPackage saves a crawled package, for crawlers not aware of leases.
 func (cs *CrawlerServer) PushPackage(r *http.Request, p *gcc.Package) {
+	c := appengine.NewContext(r)
+	pushPackage(c, &CrawledPackage{Package: *p})
+}
+
+// PushCrawledPackage saves a crawled package with the extended information. A
+// push under a lease other than the current one of the package is ignored.
+func (cs *CrawlerServer) PushCrawledPackage(r *http.Request, p *CrawledPackage) {
 	c := appengine.NewContext(r)
 	pushPackage(c, p)
 }
 
+// ReportPackageFailure acknowledges the lease of a package failed to crawl.
+// The package is retried later, or deleted after repeated permanent failures.
+func (cs *CrawlerServer) ReportPackageFailure(r *http.Request, rep *BadPackageReport) {
+	c := appengine.NewContext(r)
+	reportBadPackage(c, rep)
+}
+
+// ReportBadPackage is ReportPackageFailure for crawlers not aware of leases.
+// They report all errors this way, so the failure is regarded as transient.
 func (cs *CrawlerServer) ReportBadPackage(r *http.Request, pkg string) {
 	c := appengine.NewContext(r)
-	deletePackage(c, pkg)
+	reportBadPackage(c, &BadPackageReport{
+		Package: pkg,
+		Reason:  BadPackageUnknown,
+	})
 }
 
 func (cs *CrawlerServer) PushPerson(r *http.Request, p *gcc.Person) (NewPackage bool) {
@@ -401,7 +608,7 @@ func (cs *CrawlerServer) PushPerson(r *http.Request, p *gcc.Person) (NewPackage
 
 func (cs *CrawlerServer) TouchPackage(r *http.Request, pkg string) (earlySchedule bool) {
 	c := appengine.NewContext(r)
-	return touchPackage(c, pkg)
+	return touchPackage(c, resolveRedirect(c, pkg))
 }
 
 func (cs *CrawlerServer) AppendPackages(r *http.Request, pkgs []string) (newNum int) {
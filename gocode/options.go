@@ -0,0 +1,213 @@
+package gocode
+
+import (
+	"fmt"
+	"github.com/daviddengcn/go-villa"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sort orders of search results
+const (
+	sortRelevance = "relevance"
+	sortStars     = "stars"
+	sortImporters = "importers"
+	sortUpdated   = "updated"
+)
+
+const sinceLayout = "2006-01-02"
+
+// SearchOptions are the sort order and filters of search results, given by
+// the parameters sort, minstars, minimporters, since, nomain, noforks,
+// noabandoned, commitsince and licenses.
+type SearchOptions struct {
+	Sort         string
+	MinStars     int
+	MinImporters int
+	// only packages updated since this day, zero for all
+	Since        time.Time
+	ExcludeMain  bool
+	ExcludeForks bool
+	// excludes archived or deprecated packages
+	ExcludeAbandoned bool
+	// only packages with commits since this day, zero for all. Packages of
+	// unknown last commits are excluded.
+	CommitSince time.Time
+	// the allowed licenses, including unknownLicense, nil for all
+	Licenses []string
+	
+	// the rank model, the active one if nil
+	model *RankModel
+}
+
+func parseSearchOptions(r *http.Request) SearchOptions {
+	opts := SearchOptions{Sort: sortRelevance}
+	switch s := r.FormValue("sort"); s {
+	case sortStars, sortImporters, sortUpdated:
+		opts.Sort = s
+	}
+	opts.MinStars, _ = strconv.Atoi(r.FormValue("minstars"))
+	opts.MinImporters, _ = strconv.Atoi(r.FormValue("minimporters"))
+	if t, err := time.Parse(sinceLayout, r.FormValue("since")); err == nil {
+		opts.Since = t
+	}
+	opts.ExcludeMain = r.FormValue("nomain") != ""
+	opts.ExcludeForks = r.FormValue("noforks") != ""
+	opts.ExcludeAbandoned = r.FormValue("noabandoned") != ""
+	if t, err := time.Parse(sinceLayout, r.FormValue("commitsince")); err == nil {
+		opts.CommitSince = t
+	}
+	// licenses= given, even empty, overrides the preference of the cookie
+	if _, ok := r.Form["licenses"]; ok {
+		opts.Licenses = splitLicenses(r.FormValue("licenses"))
+	} else {
+		opts.Licenses = allowedLicenses(r)
+	}
+	return opts
+}
+
+// SinceStr returns the date of Since, "" if not set.
+func (opts SearchOptions) SinceStr() string {
+	if opts.Since.IsZero() {
+		return ""
+	}
+	return opts.Since.Format(sinceLayout)
+}
+
+// CommitSinceStr returns the date of CommitSince, "" if not set.
+func (opts SearchOptions) CommitSinceStr() string {
+	if opts.CommitSince.IsZero() {
+		return ""
+	}
+	return opts.CommitSince.Format(sinceLayout)
+}
+
+// LicensesStr returns the allowed licenses separated by commas.
+func (opts SearchOptions) LicensesStr() string {
+	return strings.Join(opts.Licenses, ",")
+}
+
+// Params returns the non-default options as "&name=value" pairs to append to
+// links of pages.
+func (opts SearchOptions) Params() template.URL {
+	v := url.Values{}
+	if opts.Sort != sortRelevance {
+		v.Set("sort", opts.Sort)
+	}
+	if opts.MinStars > 0 {
+		v.Set("minstars", fmt.Sprint(opts.MinStars))
+	}
+	if opts.MinImporters > 0 {
+		v.Set("minimporters", fmt.Sprint(opts.MinImporters))
+	}
+	if s := opts.SinceStr(); s != "" {
+		v.Set("since", s)
+	}
+	if opts.ExcludeMain {
+		v.Set("nomain", "1")
+	}
+	if opts.ExcludeForks {
+		v.Set("noforks", "1")
+	}
+	if opts.ExcludeAbandoned {
+		v.Set("noabandoned", "1")
+	}
+	if s := opts.CommitSinceStr(); s != "" {
+		v.Set("commitsince", s)
+	}
+	if len(opts.Licenses) > 0 {
+		v.Set("licenses", opts.LicensesStr())
+	}
+	if len(v) == 0 {
+		return ""
+	}
+	return template.URL("&" + v.Encode())
+}
+
+func (opts SearchOptions) match(row *DocRow) bool {
+	if row.StarCount < opts.MinStars {
+		return false
+	}
+	if row.ImportedCount < opts.MinImporters {
+		return false
+	}
+	if !opts.Since.IsZero() && row.LastUpdated.Before(opts.Since) {
+		return false
+	}
+	if opts.ExcludeMain && row.Name == "main" {
+		return false
+	}
+	if opts.ExcludeForks && row.ForkOf != "" {
+		return false
+	}
+	if opts.ExcludeAbandoned && (row.Archived || row.Deprecated) {
+		return false
+	}
+	if !opts.CommitSince.IsZero() && row.LastCommit.Before(opts.CommitSince) {
+		return false
+	}
+	if len(opts.Licenses) > 0 {
+		license := row.License
+		if license == "" {
+			license = unknownLicense
+		}
+		if !matchValues(license, opts.LicensesStr()) {
+			return false
+		}
+	}
+	return true
+}
+
+// filterRows returns the rows matching the filters of opts.
+func filterRows(rows []*DocRow, opts SearchOptions) []*DocRow {
+	res := make([]*DocRow, 0, len(rows))
+	for _, row := range rows {
+		if opts.match(row) {
+			res = append(res, row)
+		}
+	}
+	return res
+}
+
+// sortEntries sorts entries by sortBy other than sortRelevance. Entries of the
+// same key keep their order.
+func sortEntries(entries []*hitEntry, sortBy string) {
+	var less func(a, b *DocRow) bool
+	switch sortBy {
+	case sortStars:
+		less = func(a, b *DocRow) bool {
+			return a.StarCount > b.StarCount
+		}
+	case sortImporters:
+		less = func(a, b *DocRow) bool {
+			return a.ImportedCount > b.ImportedCount
+		}
+	case sortUpdated:
+		less = func(a, b *DocRow) bool {
+			return a.LastUpdated.After(b.LastUpdated)
+		}
+	default:
+		return
+	}
+
+	rank := make(map[*hitEntry]int, len(entries))
+	for i, e := range entries {
+		rank[e] = i
+	}
+	villa.SortF(len(entries), func(i, j int) bool {
+		a, b := entries[i].row, entries[j].row
+		if less(a, b) {
+			return true
+		}
+		if less(b, a) {
+			return false
+		}
+		return rank[entries[i]] < rank[entries[j]]
+	}, func(i, j int) {
+		entries[i], entries[j] = entries[j], entries[i]
+	})
+}
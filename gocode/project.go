@@ -0,0 +1,193 @@
+package gocode
+
+import (
+	"appengine"
+	"github.com/daviddengcn/go-villa"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// the maximum number of packages shown on a project page
+const maxProjectPackages = 1000
+
+// ProjectNode is a package of a project with the packages under it. Packages
+// are nested under their closest ancestor package in the project, as
+// sub-packages are folded in search results.
+type ProjectNode struct {
+	Package       string
+	SubPath       string
+	Name          string
+	Synopsis      string
+	ImportedCount int
+	Children      []*ProjectNode
+}
+
+// ProjectDependency is an external project imported by a project.
+type ProjectDependency struct {
+	Project  string
+	Packages []string
+}
+
+// ProjectPage is the content of /project.
+type ProjectPage struct {
+	Root        string
+	Name        string
+	ProjectURL  string
+	AuthorID    string
+	StarCount   int
+	LastUpdated time.Time
+	Packages    int
+	Tree        []*ProjectNode
+	// distinct packages outside the project importing any of it
+	Importers []string
+	// distinct packages outside the project imported by any of it
+	Imports      int
+	Dependencies []ProjectDependency
+	ReadmeFn     string
+	ReadmeData   string
+	ReadmeHTML   template.HTML
+}
+
+// projectTree nests docs, sorted by package, under their closest ancestors.
+func projectTree(docs []DocInfo) []*ProjectNode {
+	nodes := make(map[string]*ProjectNode, len(docs))
+	var tops []*ProjectNode
+	for _, d := range docs {
+		n := &ProjectNode{
+			Package:       d.Package,
+			SubPath:       d.Package,
+			Name:          d.Name,
+			Synopsis:      d.Synopsis,
+			ImportedCount: len(d.ImportedPkgs),
+		}
+		nodes[d.Package] = n
+		
+		parent := closestAncestor(d.Package, func(pkg string) bool {
+			_, ok := nodes[pkg]
+			return ok
+		})
+		if parent == "" {
+			tops = append(tops, n)
+			continue
+		}
+		n.SubPath = d.Package[len(parent):]
+		nodes[parent].Children = append(nodes[parent].Children, n)
+	}
+	return tops
+}
+
+// loadProject returns the page of the project at root, nil if none of its
+// packages is indexed.
+func loadProject(c appengine.Context, root string) (*ProjectPage, error) {
+	docs, err := prefixDocs(c, root+"/", maxProjectPackages)
+	if err != nil {
+		return nil, err
+	}
+	var rootDoc DocInfo
+	err, exists := NewCachedDocDB(c, kindDocDB).Get(root, &rootDoc)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		docs = append([]DocInfo{rootDoc}, docs...)
+	}
+	if len(docs) == 0 {
+		return nil, nil
+	}
+	
+	villa.SortF(len(docs), func(i, j int) bool {
+		return docs[i].Package < docs[j].Package
+	}, func(i, j int) {
+		docs[i], docs[j] = docs[j], docs[i]
+	})
+	
+	p := &ProjectPage{
+		Root:        root,
+		Name:        projectOfPackage(root),
+		ProjectURL:  docs[0].ProjectURL,
+		AuthorID:    personOfPackage(root),
+		LastUpdated: docs[0].LastUpdated,
+		Packages:    len(docs),
+		Tree:        projectTree(docs),
+	}
+	inProject := func(pkg string) bool {
+		return pkg == root || strings.HasPrefix(pkg, root+"/")
+	}
+	importers, imports := make(villa.StrSet), make(villa.StrSet)
+	for _, d := range docs {
+		if d.StarCount > p.StarCount {
+			p.StarCount = d.StarCount
+		}
+		if d.LastUpdated.After(p.LastUpdated) {
+			p.LastUpdated = d.LastUpdated
+		}
+		if p.ReadmeData == "" && d.ReadmeData != "" {
+			p.ReadmeFn, p.ReadmeData = d.ReadmeFn, d.ReadmeData
+			p.ReadmeHTML = renderReadme(d.ReadmeFn, d.ReadmeData, d.Package,
+				d.ProjectURL)
+		}
+		for _, imp := range d.ImportedPkgs {
+			if !inProject(imp) {
+				importers.Put(imp)
+			}
+		}
+		for _, imp := range d.Imports {
+			if !inProject(imp) {
+				imports.Put(imp)
+			}
+		}
+	}
+	p.Importers = importers.Elements()
+	sort.Strings(p.Importers)
+	p.Imports = len(imports)
+	
+	deps := make(map[string]*ProjectDependency)
+	var projs []string
+	for imp := range imports {
+		proj := projectRootOfPackage(imp)
+		if deps[proj] == nil {
+			deps[proj] = &ProjectDependency{Project: proj}
+			projs = append(projs, proj)
+		}
+		deps[proj].Packages = append(deps[proj].Packages, imp)
+	}
+	sort.Strings(projs)
+	for _, proj := range projs {
+		sort.Strings(deps[proj].Packages)
+		p.Dependencies = append(p.Dependencies, *deps[proj])
+	}
+	return p, nil
+}
+
+// pageProject shows the project ?id=, redirecting sub-packages to the root.
+func pageProject(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimSpace(r.FormValue("id")), "/")
+	if id == "" {
+		http.Error(w, "No such project", http.StatusNotFound)
+		return
+	}
+	root := projectRootOfPackage(id)
+	if root != id {
+		http.Redirect(w, r, "project?id="+template.URLQueryEscaper(root),
+			http.StatusMovedPermanently)
+		return
+	}
+	
+	c := appengine.NewContext(r)
+	p, err := loadProject(c, root)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if p == nil {
+		http.Error(w, "No such project", http.StatusNotFound)
+		return
+	}
+	
+	if err := templates.ExecuteTemplate(w, "project.html", p); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
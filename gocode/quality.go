@@ -0,0 +1,151 @@
+package gocode
+
+import (
+	"appengine"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Code quality signals are measured by the crawler and add to the static
+// score by weights edited on /quality. Saving the weights restarts the sweep
+// of rescoreDocs, which queues all packages whose scores change.
+const (
+	qualityWeightsID = "weights"
+	// the weights are reloaded after this interval
+	qualityWeightsReloadInterval = 10 * time.Minute
+	// the maximum penalty of go vet issues
+	maxVetPenalty = 0.5
+)
+
+// PackageQuality is the code quality of a package measured by the crawler.
+type PackageQuality struct {
+	// false if the crawler did not measure the quality
+	QualityMeasured bool
+	HasTests        bool
+	// true if the package has runnable examples, i.e. with outputs
+	HasExamples bool
+	// fraction of the exported identifiers with doc comments
+	DocCoverage float64
+	// the number of issues reported by go vet
+	VetIssues int
+}
+
+// qualityOf returns the quality of d.
+func qualityOf(d *DocInfo) PackageQuality {
+	return PackageQuality{
+		QualityMeasured: d.QualityMeasured,
+		HasTests:        d.HasTests,
+		HasExamples:     d.HasExamples,
+		DocCoverage:     d.DocCoverage,
+		VetIssues:       d.VetIssues,
+	}
+}
+
+// QualityWeights are the weights of the quality signals in the static score.
+type QualityWeights struct {
+	Tests       float64 `datastore:",noindex"`
+	Examples    float64 `datastore:",noindex"`
+	DocCoverage float64 `datastore:",noindex"`
+	// the penalty of each go vet issue, at most maxVetPenalty in total
+	VetIssue float64 `datastore:",noindex"`
+}
+
+func defaultQualityWeights() *QualityWeights {
+	return &QualityWeights{
+		Tests:       0.3,
+		Examples:    0.2,
+		DocCoverage: 0.5,
+		VetIssue:    0.05,
+	}
+}
+
+var qualityWeightsCache struct {
+	sync.Mutex
+	w        *QualityWeights
+	loadTime time.Time
+}
+
+func loadQualityWeights(c appengine.Context) *QualityWeights {
+	var w QualityWeights
+	err, exists := NewDocDB(c, kindQualityWeights).Get(qualityWeightsID, &w)
+	if err != nil {
+		c.Errorf("Get(%s, %s) failed: %v", kindQualityWeights, qualityWeightsID,
+			err)
+	}
+	if !exists {
+		return defaultQualityWeights()
+	}
+	return &w
+}
+
+func saveQualityWeights(c appengine.Context, w *QualityWeights) error {
+	if err := NewDocDB(c, kindQualityWeights).Put(qualityWeightsID, w); err != nil {
+		return err
+	}
+
+	qualityWeightsCache.Lock()
+	qualityWeightsCache.loadTime = time.Time{}
+	qualityWeightsCache.Unlock()
+	// rankings change
+	bumpIndexGeneration(c)
+	if err := restartRescore(c); err != nil {
+		c.Errorf("restartRescore failed: %v", err)
+	}
+	return nil
+}
+
+// qualityWeights returns the current weights, reloading them if expired.
+func qualityWeights(c appengine.Context) *QualityWeights {
+	qualityWeightsCache.Lock()
+	defer qualityWeightsCache.Unlock()
+
+	if qualityWeightsCache.w != nil &&
+			time.Now().Sub(qualityWeightsCache.loadTime) < qualityWeightsReloadInterval {
+		return qualityWeightsCache.w
+	}
+
+	w := loadQualityWeights(c)
+	qualityWeightsCache.w, qualityWeightsCache.loadTime = w, time.Now()
+	return w
+}
+
+// pageQuality shows and edits the quality weights.
+func pageQuality(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if r.Method == "POST" {
+		var qw QualityWeights
+		for _, f := range []struct {
+			name string
+			v    *float64
+		}{
+			{"tests", &qw.Tests},
+			{"examples", &qw.Examples},
+			{"doccoverage", &qw.DocCoverage},
+			{"vetissue", &qw.VetIssue},
+		} {
+			v, err := strconv.ParseFloat(r.FormValue(f.name), 64)
+			if err != nil || v < 0 {
+				http.Error(w, "Invalid weight of "+f.name, http.StatusBadRequest)
+				return
+			}
+			*f.v = v
+		}
+		if err := saveQualityWeights(c, &qw); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err := templates.ExecuteTemplate(w, "quality.html", struct {
+		Weights *QualityWeights
+		Default *QualityWeights
+	}{
+		Weights: loadQualityWeights(c),
+		Default: defaultQualityWeights(),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -1,12 +1,32 @@
 package gocode
 
 import (
+	"fmt"
 	"github.com/daviddengcn/go-villa"
 	"math"
 	"strings"
+	"time"
 )
 
-// TODO: author's authority
+// The static score decays with the time since the last commit, halving its
+// distance to minFreshness every freshnessHalfLife, and is cut further for
+// archived or deprecated packages. Scores that drifted as time passes are
+// updated by rescoreDocs.
+const (
+	freshnessHalfLife = 2 * 365 * 24 * time.Hour
+	minFreshness      = 0.5
+	abandonedFactor   = 0.5
+)
+
+// freshness returns the factor of the static score of a package last committed
+// at lastCommit, 1 if unknown.
+func freshness(lastCommit, now time.Time) float64 {
+	if lastCommit.IsZero() || !lastCommit.Before(now) {
+		return 1
+	}
+	halves := float64(now.Sub(lastCommit)) / float64(freshnessHalfLife)
+	return minFreshness + (1-minFreshness)*math.Pow(0.5, halves)
+}
 
 func minFloat(a, b float64) float64 {
 	if a < b {
@@ -66,8 +86,37 @@ func projectOfPackage(pkg string) string {
 	return pkg
 }
 
-func calcStaticRank(doc *DocInfo) float64 {
+// projectRootOfPackage returns the import path of the repository root of pkg,
+// e.g. github.com/user/repo for github.com/user/repo/sub.
+func projectRootOfPackage(pkg string) string {
+	parts := strings.Split(pkg, "/")
+	switch parts[0] {
+	case "github.com", "code.google.com", "bitbucket.org":
+		if len(parts) > 3 {
+			return strings.Join(parts[:3], "/")
+		}
+	case "launchpad.net":
+		if len(parts) > 3 && strings.HasPrefix(parts[1], "~") {
+			return strings.Join(parts[:4], "/")
+		}
+		if len(parts) > 2 {
+			return strings.Join(parts[:2], "/")
+		}
+	}
+	return pkg
+}
+
+func calcStaticRank(doc *DocInfo, qw *QualityWeights) float64 {
+	return staticRank(doc, qw, nil)
+}
+
+// staticRank returns the static score of doc with quality weights qw. The
+// parts of the score are appended to ex if it is not nil.
+func staticRank(doc *DocInfo, qw *QualityWeights, ex *StaticExplain) float64 {
 	s := float64(1)
+	if ex != nil {
+		ex.Base = s
+	}
 
 	author := doc.Author
 	if author == "" {
@@ -91,71 +140,192 @@ func calcStaticRank(doc *DocInfo) float64 {
 	for _, imp := range doc.ImportedPkgs {
 		impProject := projectOfPackage(imp)
 		
-		vl := scoreOfPkgByProject(projectCount[impProject], impProject == project)
+		byProject := scoreOfPkgByProject(projectCount[impProject], impProject == project)
+		vl := byProject
 
 		impAuthor := authorOfPackage(imp)
+		byAuthor := 0.
 		if impAuthor != "" {
-			vl = minFloat(vl, scoreOfPkgByAuthor(authorCount[impAuthor], impAuthor == author))
+			byAuthor = scoreOfPkgByAuthor(authorCount[impAuthor], impAuthor == author)
+			vl = minFloat(vl, byAuthor)
 		}
 
 		s += vl
+		if ex != nil {
+			ex.Importers = append(ex.Importers, ImporterExplain{
+				Package:      imp,
+				ProjectCount: projectCount[impProject],
+				SameProject:  impProject == project,
+				ByProject:    byProject,
+				AuthorCount:  authorCount[impAuthor],
+				SameAuthor:   impAuthor != "" && impAuthor == author,
+				ByAuthor:     byAuthor,
+				Score:        vl,
+			})
+		}
 	}
 
+	bonus := func(reason string, vl float64) {
+		s += vl
+		if ex != nil {
+			ex.Bonuses = append(ex.Bonuses, Bonus{reason, vl})
+		}
+	}
 	desc := strings.TrimSpace(doc.Description)
 	if len(desc) > 0 {
-		s += 1
+		bonus("description", 1)
 		if len(desc) > 100 {
-			s += 0.5
+			bonus("description longer than 100 bytes", 0.5)
 		}
 
 		if strings.HasPrefix(desc, "Package "+doc.Name) {
-			s += 0.5
+			bonus("description starts with \"Package "+doc.Name+"\"", 0.5)
 		} else if strings.HasPrefix(desc, "package "+doc.Name) {
-			s += 0.4
+			bonus("description starts with \"package "+doc.Name+"\"", 0.4)
 		}
 	}
 	
 	if doc.Name != "" && doc.Name != "main" {
-		s += 0.1
+		bonus("not a command", 0.1)
+	}
+
+	if doc.AuthorScore > 0 {
+		bonus("authority of author "+author, authorScoreWeight*doc.AuthorScore)
 	}
 
 	starCount := doc.StarCount - 3
 	if starCount < 0 {
 		starCount = 0
 	}
-	s += math.Sqrt(float64(starCount)) * 0.5
+	if starCount > 0 {
+		bonus(fmt.Sprintf("%d stars", doc.StarCount),
+			math.Sqrt(float64(starCount)) * 0.5)
+	}
 
+	if doc.QualityMeasured {
+		if doc.HasTests {
+			bonus("has tests", qw.Tests)
+		}
+		if doc.HasExamples {
+			bonus("has runnable examples", qw.Examples)
+		}
+		if doc.DocCoverage > 0 {
+			bonus(fmt.Sprintf("%.0f%% of exported identifiers documented",
+				doc.DocCoverage*100), qw.DocCoverage*minFloat(doc.DocCoverage, 1))
+		}
+		// vet issues never take the score below the base
+		penalty := minFloat(minFloat(qw.VetIssue*float64(doc.VetIssues),
+			maxVetPenalty), s-1)
+		if doc.VetIssues > 0 && penalty > 0 {
+			bonus(fmt.Sprintf("%d go vet issues", doc.VetIssues), -penalty)
+		}
+	}
+
+	// the factors apply to the whole score, shown as negative bonuses
+	if f := freshness(doc.LastCommit, time.Now()); f < 1 {
+		bonus(fmt.Sprintf("last commit on %s (x%.2f)",
+			doc.LastCommit.Format("2006-01-02"), f), s*(f-1))
+	}
+	if doc.Archived || doc.Deprecated {
+		reason := "archived"
+		if doc.Deprecated {
+			reason = "deprecated"
+		}
+		bonus(fmt.Sprintf("%s (x%.2f)", reason, abandonedFactor),
+			s*(abandonedFactor-1))
+	}
+
+	if ex != nil {
+		ex.Total = s
+	}
 	return s
 }
 
-func calcMatchScore(doc *DocInfo, tokens villa.StrSet) float64 {
-	if len(tokens) == 0 {
-		return 1.
+// matchGroup returns 1 if the term of g matches, SynonymWeight if only a
+// synonym matches, and 0 otherwise.
+func matchGroup(g QueryGroup, text string, tokens villa.StrSet) float64 {
+	if matchToken(g.Token, text, tokens) {
+		return 1
 	}
+	
+	for _, syn := range g.Synonyms {
+		matched := true
+		for token := range syn {
+			if !matchToken(token, text, tokens) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return SynonymWeight
+		}
+	}
+	return 0
+}
 
-	s := float64(0.02 * float64(len(tokens)))
+// the weights of a query term matching the fields of a document
+const (
+	matchBaseWeight     = 0.02
+	synopsisMatchWeight = 0.25
+	nameMatchWeight     = 0.4
+	packageMatchWeight  = 0.1
+)
 
+// maxMatchScore returns the upper bound of calcMatchScore of groups.
+func maxMatchScore(groups []QueryGroup) float64 {
+	if len(groups) == 0 {
+		return 1.
+	}
+	return (matchBaseWeight + synopsisMatchWeight + nameMatchWeight +
+		packageMatchWeight) * float64(len(groups))
+}
+
+// groupMatches returns the matchGroup values of each of groups in the name,
+// the synopsis and the import path of doc.
+func groupMatches(doc *DocInfo, groups []QueryGroup) (name, synopsis,
+		pkg []float64) {
 	filteredSyn := filterURLs(doc.Synopsis)
-	synopsis := strings.ToLower(filteredSyn)
-	synTokens := appendTokens(nil, filteredSyn)
-	name := strings.ToLower(doc.Name)
-	nameTokens := appendTokens(nil, name)
-	pkg := strings.ToLower(doc.Package)
-	pkgTokens := appendTokens(nil, doc.Package)
+	synText := strings.ToLower(filteredSyn)
+	synTokens := analyzeTokens(textAnalyzer, nil, filteredSyn)
+	nameText := strings.ToLower(doc.Name)
+	nameTokens := analyzeTokens(nameAnalyzer, nil, doc.Name)
+	pkgText := strings.ToLower(doc.Package)
+	pkgTokens := analyzeTokens(packageAnalyzer, nil, doc.Package)
 
-	for token := range tokens {
-		if matchToken(token, synopsis, synTokens) {
-			s += 0.25
-		}
+	for _, g := range groups {
+		synopsis = append(synopsis, matchGroup(g, synText, synTokens))
+		name = append(name, matchGroup(g, nameText, nameTokens))
+		pkg = append(pkg, matchGroup(g, pkgText, pkgTokens))
+	}
+	return name, synopsis, pkg
+}
 
-		if matchToken(token, name, nameTokens) {
-			s += 0.4
-		}
+// matchFeatures returns the fractions of groups matching the name, the
+// synopsis and the import path of doc.
+func matchFeatures(doc *DocInfo, groups []QueryGroup) (name, synopsis,
+		pkg float64) {
+	if len(groups) == 0 {
+		return 1, 1, 1
+	}
 
-		if matchToken(token, pkg, pkgTokens) {
-			s += 0.1
-		}
+	names, synopses, pkgs := groupMatches(doc, groups)
+	for i := range groups {
+		name += names[i]
+		synopsis += synopses[i]
+		pkg += pkgs[i]
 	}
 
-	return s
+	n := float64(len(groups))
+	return name / n, synopsis / n, pkg / n
+}
+
+func calcMatchScore(doc *DocInfo, groups []QueryGroup) float64 {
+	if len(groups) == 0 {
+		return 1.
+	}
+
+	name, synopsis, pkg := matchFeatures(doc, groups)
+	n := float64(len(groups))
+	return n * (matchBaseWeight + synopsisMatchWeight*synopsis +
+		nameMatchWeight*name + packageMatchWeight*pkg)
 }
@@ -0,0 +1,1001 @@
+package gocode
+
+import (
+	"bytes"
+	"go/scanner"
+	"go/token"
+	"html/template"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// READMEs are rendered by the format of their file names: Markdown, reST or
+// plain text. Only the subsets of the formats common in READMEs are supported.
+// The output is safe by construction: all text, including raw HTML in the
+// source, is escaped, only a fixed set of tags is generated, and only http,
+// https and mailto URLs are linked. Relative links and images are resolved
+// against the project URL, and Go code blocks are highlighted.
+const (
+	readmeMarkdown = "markdown"
+	readmeRST      = "rst"
+	readmeText     = "text"
+)
+
+// readmeFormat returns the format of a README file named fn.
+func readmeFormat(fn string) string {
+	switch strings.ToLower(path.Ext(fn)) {
+	case ".md", ".markdown", ".mdown", ".mkd", ".mkdn":
+		return readmeMarkdown
+	case ".rst", ".rest":
+		return readmeRST
+	}
+	return readmeText
+}
+
+// renderReadme returns the HTML of the README fn of pkg with contents data.
+func renderReadme(fn, data, pkg, projectURL string) template.HTML {
+	if strings.TrimSpace(data) == "" {
+		return ""
+	}
+	lines := splitReadmeLines(data)
+	links := newReadmeLinks(pkg, projectURL)
+	switch readmeFormat(fn) {
+	case readmeMarkdown:
+		r := &mdRenderer{links: links, refs: make(map[string]string)}
+		r.render(lines)
+		return template.HTML(r.buf.String())
+	case readmeRST:
+		r := &rstRenderer{links: links, targets: make(map[string]string)}
+		r.render(lines)
+		return template.HTML(r.buf.String())
+	}
+	return template.HTML("<pre>" + template.HTMLEscapeString(data) + "</pre>")
+}
+
+// splitReadmeLines splits text into lines with leading tabs expanded.
+func splitReadmeLines(text string) []string {
+	lines := strings.Split(strings.Replace(text, "\r\n", "\n", -1), "\n")
+	for i, line := range lines {
+		n := 0
+		for n < len(line) && (line[n] == ' ' || line[n] == '\t') {
+			n++
+		}
+		if strings.Contains(line[:n], "\t") {
+			col := 0
+			for _, c := range line[:n] {
+				if c == '\t' {
+					col += 4 - col%4
+				} else {
+					col++
+				}
+			}
+			lines[i] = strings.Repeat(" ", col) + line[n:]
+		}
+	}
+	return lines
+}
+
+func indentOf(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// dedent removes up to n leading spaces of line.
+func dedent(line string, n int) string {
+	if in := indentOf(line); in < n {
+		n = in
+	}
+	return line[n:]
+}
+
+func isBlank(line string) bool {
+	return strings.TrimSpace(line) == ""
+}
+
+// readmeLinks resolves the URLs of a README.
+type readmeLinks struct {
+	// the bases of relative links and images, "" if unknown
+	link, raw string
+	// the directory of the package in the repository, e.g. "sub/"
+	dir string
+}
+
+func newReadmeLinks(pkg, projectURL string) readmeLinks {
+	var l readmeLinks
+	if pkg != "" {
+		if dir := strings.TrimPrefix(pkg, projectRootOfPackage(pkg)); dir != "" {
+			l.dir = strings.TrimPrefix(dir, "/") + "/"
+		}
+	}
+	u, err := url.Parse(projectURL)
+	if err != nil || u.Scheme != "http" && u.Scheme != "https" {
+		return l
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	switch {
+	case u.Host == "github.com" && len(parts) >= 2:
+		l.link = "https://github.com/" + parts[0] + "/" + parts[1] + "/blob/HEAD/"
+		l.raw = "https://raw.githubusercontent.com/" + parts[0] + "/" + parts[1] +
+			"/HEAD/"
+	case u.Host == "bitbucket.org" && len(parts) >= 2:
+		base := "https://bitbucket.org/" + parts[0] + "/" + parts[1]
+		l.link, l.raw = base+"/src/HEAD/", base+"/raw/HEAD/"
+	default:
+		l.link = strings.TrimSuffix(projectURL, "/") + "/"
+		l.raw = l.link
+	}
+	return l
+}
+
+// resolve returns the safe absolute URL of u, "" if u is not allowed.
+func (l readmeLinks) resolve(u string, image bool) string {
+	u = strings.TrimSpace(u)
+	pu, err := url.Parse(u)
+	if u == "" || err != nil {
+		return ""
+	}
+	switch {
+	case pu.Scheme != "":
+		switch strings.ToLower(pu.Scheme) {
+		case "http", "https":
+			return u
+		case "mailto":
+			if !image {
+				return u
+			}
+		}
+		return ""
+	case strings.HasPrefix(u, "//"):
+		return "https:" + u
+	case strings.HasPrefix(u, "#"):
+		if image {
+			return ""
+		}
+		return u
+	}
+	
+	base := l.link
+	if image {
+		base = l.raw
+	}
+	if base == "" {
+		return ""
+	}
+	p := pu.Path
+	if strings.HasPrefix(p, "/") {
+		p = strings.TrimPrefix(path.Clean(p), "/")
+	} else {
+		p = strings.TrimPrefix(path.Clean("/"+l.dir+p), "/")
+	}
+	if pu.RawQuery != "" {
+		p += "?" + pu.RawQuery
+	}
+	if pu.Fragment != "" {
+		p += "#" + pu.Fragment
+	}
+	return base + p
+}
+
+// writeLink writes a link to u with html as the text, or only the text if u
+// is not allowed.
+func (l readmeLinks) writeLink(buf *bytes.Buffer, u, html string) {
+	href := l.resolve(u, false)
+	if href == "" {
+		buf.WriteString(html)
+		return
+	}
+	buf.WriteString(`<a href="` + template.HTMLEscapeString(href) +
+		`" rel="nofollow">` + html + `</a>`)
+}
+
+func (l readmeLinks) writeImage(buf *bytes.Buffer, u, alt string) {
+	src := l.resolve(u, true)
+	if src == "" {
+		template.HTMLEscape(buf, []byte(alt))
+		return
+	}
+	buf.WriteString(`<img src="` + template.HTMLEscapeString(src) + `" alt="` +
+		template.HTMLEscapeString(alt) + `">`)
+}
+
+// writeCode writes a code block, highlighted if lang is Go.
+func writeCode(buf *bytes.Buffer, code, lang string) {
+	buf.WriteString(`<pre class="code">`)
+	switch strings.ToLower(lang) {
+	case "go", "golang":
+		buf.WriteString(string(highlightGo(code)))
+	default:
+		template.HTMLEscape(buf, []byte(code))
+	}
+	buf.WriteString("</pre>\n")
+}
+
+// highlightGo returns the HTML of the Go source src with keywords, literals
+// and comments in spans of classes kw, str, num and com.
+func highlightGo(src string) template.HTML {
+	fset := token.NewFileSet()
+	file := fset.AddFile("", fset.Base(), len(src))
+	var s scanner.Scanner
+	// snippets are often incomplete, errors are ignored
+	s.Init(file, []byte(src), nil, scanner.ScanComments)
+	
+	var buf bytes.Buffer
+	last := 0
+	for {
+		pos, tok, lit := s.Scan()
+		if tok == token.EOF {
+			break
+		}
+		if tok == token.SEMICOLON && lit == "\n" {
+			// an inserted semicolon
+			continue
+		}
+		start := file.Offset(pos)
+		text := lit
+		if text == "" {
+			text = tok.String()
+		}
+		end := start + len(text)
+		if start < last || end > len(src) {
+			continue
+		}
+		
+		class := ""
+		switch {
+		case tok.IsKeyword():
+			class = "kw"
+		case tok == token.STRING || tok == token.CHAR:
+			class = "str"
+		case tok == token.INT || tok == token.FLOAT || tok == token.IMAG:
+			class = "num"
+		case tok == token.COMMENT:
+			class = "com"
+		}
+		if class == "" {
+			continue
+		}
+		template.HTMLEscape(&buf, []byte(src[last:start]))
+		buf.WriteString(`<span class="` + class + `">`)
+		template.HTMLEscape(&buf, []byte(src[start:end]))
+		buf.WriteString(`</span>`)
+		last = end
+	}
+	template.HTMLEscape(&buf, []byte(src[last:]))
+	return template.HTML(buf.String())
+}
+
+// isURLStart returns true if a bare URL starts at s[i].
+func isURLStart(s string, i int) bool {
+	if i > 0 && isWordRune(rune(s[i-1])) {
+		return false
+	}
+	return strings.HasPrefix(s[i:], "http://") || strings.HasPrefix(s[i:], "https://")
+}
+
+// bareURLEnd returns the end of the bare URL starting at s[i].
+func bareURLEnd(s string, i int) int {
+	j := i
+	for j < len(s) && s[j] > ' ' && s[j] != '<' && s[j] != '>' && s[j] != '"' {
+		j++
+	}
+	for j > i && strings.IndexByte(".,;:!?)'*_", s[j-1]) >= 0 {
+		j--
+	}
+	return j
+}
+
+// headingTag returns the tag of a README heading of level, 1-based, shifted
+// below the headings of the page.
+func headingTag(level int) string {
+	level += 2
+	if level > 6 {
+		level = 6
+	}
+	return "h" + string('0'+byte(level))
+}
+
+var (
+	mdHeadingRe = regexp.MustCompile(`^ {0,3}(#{1,6})[ \t]*(.*?)(?:[ \t]+#+)?[ \t]*$`)
+	mdFenceRe   = regexp.MustCompile("^( {0,3})(`{3,}|~{3,})[ \t]*([^`\\s]*)")
+	mdRuleRe    = regexp.MustCompile(`^ {0,3}(?:(?:\*[ \t]*){3,}|(?:-[ \t]*){3,}|(?:_[ \t]*){3,})$`)
+	mdListRe    = regexp.MustCompile(`^( {0,3})([-*+]|\d{1,9}[.)])(?:[ \t]+|$)`)
+	mdQuoteRe   = regexp.MustCompile(`^ {0,3}> ?`)
+	mdRefDefRe  = regexp.MustCompile(`^ {0,3}\[([^\]]+)\]:[ \t]*<?([^\s>]+)>?(?:[ \t]+.*)?$`)
+	mdSetextRe  = regexp.MustCompile(`^ {0,3}(=+|-+)[ \t]*$`)
+	mdAutoRe    = regexp.MustCompile(`^<((?:https?|mailto):[^\s<>]+)>`)
+)
+
+// mdRenderer renders Markdown.
+type mdRenderer struct {
+	links readmeLinks
+	// link reference definitions by lower-case labels
+	refs map[string]string
+	// paragraphs of tight list items are not wrapped in <p>
+	tight bool
+	buf   bytes.Buffer
+}
+
+func (r *mdRenderer) render(lines []string) {
+	for _, line := range lines {
+		if m := mdRefDefRe.FindStringSubmatch(line); m != nil {
+			label := strings.ToLower(m[1])
+			if _, ok := r.refs[label]; !ok {
+				r.refs[label] = m[2]
+			}
+		}
+	}
+	r.blocks(lines)
+}
+
+// startsBlock returns true if line starts a block other than a paragraph.
+func (r *mdRenderer) startsBlock(line string) bool {
+	return mdFenceRe.MatchString(line) || mdRuleRe.MatchString(line) ||
+		mdQuoteRe.MatchString(line) || mdListRe.MatchString(line) ||
+		strings.HasPrefix(strings.TrimLeft(line, " "), "#") &&
+			mdHeadingRe.MatchString(line)
+}
+
+func (r *mdRenderer) blocks(lines []string) {
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		switch {
+		case isBlank(line):
+			i++
+		
+		case mdFenceRe.MatchString(line):
+			m := mdFenceRe.FindStringSubmatch(line)
+			indent, fence, lang := len(m[1]), m[2], m[3]
+			var code []string
+			for i++; i < len(lines); i++ {
+				t := strings.TrimSpace(lines[i])
+				if strings.HasPrefix(t, fence) && strings.Trim(t, fence[:1]) == "" {
+					i++
+					break
+				}
+				code = append(code, dedent(lines[i], indent))
+			}
+			writeCode(&r.buf, strings.Join(code, "\n"), lang)
+		
+		case indentOf(line) >= 4:
+			var code []string
+			for ; i < len(lines) && (isBlank(lines[i]) || indentOf(lines[i]) >= 4); i++ {
+				code = append(code, dedent(lines[i], 4))
+			}
+			for len(code) > 0 && isBlank(code[len(code)-1]) {
+				code = code[:len(code)-1]
+			}
+			writeCode(&r.buf, strings.Join(code, "\n"), "")
+		
+		case mdRuleRe.MatchString(line):
+			r.buf.WriteString("<hr>\n")
+			i++
+		
+		case strings.HasPrefix(strings.TrimLeft(line, " "), "#") &&
+				mdHeadingRe.MatchString(line):
+			m := mdHeadingRe.FindStringSubmatch(line)
+			r.heading(len(m[1]), m[2])
+			i++
+		
+		case mdQuoteRe.MatchString(line):
+			var quoted []string
+			for ; i < len(lines) && mdQuoteRe.MatchString(lines[i]); i++ {
+				quoted = append(quoted, mdQuoteRe.ReplaceAllString(lines[i], ""))
+			}
+			tight := r.tight
+			r.tight = false
+			r.buf.WriteString("<blockquote>\n")
+			r.blocks(quoted)
+			r.buf.WriteString("</blockquote>\n")
+			r.tight = tight
+		
+		case mdListRe.MatchString(line):
+			i = r.list(lines, i)
+		
+		case mdRefDefRe.MatchString(line):
+			i++
+		
+		default:
+			para := []string{strings.TrimSpace(line)}
+			heading := 0
+			for i++; i < len(lines) && !isBlank(lines[i]); i++ {
+				if m := mdSetextRe.FindStringSubmatch(lines[i]); m != nil {
+					heading = 2
+					if m[1][0] == '=' {
+						heading = 1
+					}
+					i++
+					break
+				}
+				if r.startsBlock(lines[i]) {
+					break
+				}
+				para = append(para, strings.TrimSpace(lines[i]))
+			}
+			text := strings.Join(para, "\n")
+			if heading > 0 {
+				r.heading(heading, text)
+			} else if r.tight {
+				r.buf.WriteString(r.inline(text) + "\n")
+			} else {
+				r.buf.WriteString("<p>" + r.inline(text) + "</p>\n")
+			}
+		}
+	}
+}
+
+func (r *mdRenderer) heading(level int, text string) {
+	tag := headingTag(level)
+	r.buf.WriteString("<" + tag + ">" + r.inline(text) + "</" + tag + ">\n")
+}
+
+func isOrderedMarker(marker string) bool {
+	return marker[0] >= '0' && marker[0] <= '9'
+}
+
+// list renders the list starting at lines[i], returning the index after it.
+func (r *mdRenderer) list(lines []string, i int) int {
+	ordered := isOrderedMarker(mdListRe.FindStringSubmatch(lines[i])[2])
+	var items [][]string
+	// the indent of the contents of the current item
+	w := 0
+	for i < len(lines) {
+		line := lines[i]
+		if m := mdListRe.FindStringSubmatch(line); m != nil &&
+				(items == nil || indentOf(line) < w) {
+			if isOrderedMarker(m[2]) != ordered {
+				break
+			}
+			w = len(m[0])
+			if isBlank(line[len(m[0]):]) {
+				w = len(m[1]) + len(m[2]) + 1
+			}
+			items = append(items, []string{line[len(m[0]):]})
+			i++
+			continue
+		}
+		
+		item := items[len(items)-1]
+		switch {
+		case isBlank(line):
+			item = append(item, "")
+		case indentOf(line) >= w:
+			item = append(item, dedent(line, w))
+		case !isBlank(item[len(item)-1]) && !r.startsBlock(line):
+			// a lazy continuation of a paragraph
+			item = append(item, strings.TrimLeft(line, " "))
+		default:
+			item = nil
+		}
+		if item == nil {
+			break
+		}
+		items[len(items)-1] = item
+		i++
+	}
+	
+	// a list is loose if any of its items are separated by blank lines
+	loose := false
+	for j, item := range items {
+		n := len(item)
+		for n > 0 && isBlank(item[n-1]) {
+			n--
+		}
+		if n < len(item) && j < len(items)-1 {
+			loose = true
+		}
+		for _, line := range item[:n] {
+			loose = loose || isBlank(line)
+		}
+		items[j] = item[:n]
+	}
+	
+	tag := "ul"
+	if ordered {
+		tag = "ol"
+	}
+	tight := r.tight
+	r.tight = !loose
+	r.buf.WriteString("<" + tag + ">\n")
+	for _, item := range items {
+		r.buf.WriteString("<li>")
+		r.blocks(item)
+		r.buf.WriteString("</li>\n")
+	}
+	r.buf.WriteString("</" + tag + ">\n")
+	r.tight = tight
+	return i
+}
+
+// matchBracket returns the index of the bracket closing s[i], -1 if none.
+func matchBracket(s string, i int, open, close byte) int {
+	depth := 0
+	for j := i; j < len(s); j++ {
+		switch s[j] {
+		case '\\':
+			j++
+		case open:
+			depth++
+		case close:
+			depth--
+			if depth == 0 {
+				return j
+			}
+		}
+	}
+	return -1
+}
+
+// parseLink parses a link at s[i], '[', returning the text, the URL and the
+// index after the link.
+func (r *mdRenderer) parseLink(s string, i int) (text, u string, end int, ok bool) {
+	j := matchBracket(s, i, '[', ']')
+	if j < 0 {
+		return "", "", 0, false
+	}
+	text = s[i+1 : j]
+	switch {
+	case j+1 < len(s) && s[j+1] == '(':
+		k := matchBracket(s, j+1, '(', ')')
+		if k < 0 {
+			return "", "", 0, false
+		}
+		dest := strings.Fields(s[j+2 : k])
+		if len(dest) > 0 {
+			u = strings.TrimSuffix(strings.TrimPrefix(dest[0], "<"), ">")
+		}
+		return text, u, k + 1, true
+	case j+1 < len(s) && s[j+1] == '[':
+		k := strings.IndexByte(s[j+2:], ']')
+		if k < 0 {
+			return "", "", 0, false
+		}
+		label := s[j+2 : j+2+k]
+		if label == "" {
+			label = text
+		}
+		u, ok = r.refs[strings.ToLower(label)]
+		return text, u, j + 3 + k, ok
+	}
+	u, ok = r.refs[strings.ToLower(text)]
+	return text, u, j + 1, ok
+}
+
+const mdPunct = "!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~"
+
+// emphasisEnd returns the index of the delimiter closing the emphasis by
+// delim at s[i:], -1 if none.
+func emphasisEnd(s string, i int, delim string) int {
+	start := i + len(delim)
+	if start >= len(s) || s[start] == ' ' || s[start] == '\n' {
+		return -1
+	}
+	c := delim[0]
+	if c == '_' && i > 0 && isWordRune(rune(s[i-1])) {
+		return -1
+	}
+	for j := start + 1; j+len(delim) <= len(s); j++ {
+		if s[j] == '\\' || s[j] == '`' {
+			// skip escapes and code spans
+			if s[j] == '`' {
+				if k := strings.IndexByte(s[j+1:], '`'); k >= 0 {
+					j += k + 1
+				}
+			} else {
+				j++
+			}
+			continue
+		}
+		if !strings.HasPrefix(s[j:], delim) || s[j-1] == ' ' {
+			continue
+		}
+		after := j + len(delim)
+		if after < len(s) && s[after] == c {
+			continue
+		}
+		if c == '_' && after < len(s) && isWordRune(rune(s[after])) {
+			continue
+		}
+		return j
+	}
+	return -1
+}
+
+// inline returns the HTML of the inline Markdown s.
+func (r *mdRenderer) inline(s string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && strings.IndexByte(mdPunct, s[i+1]) >= 0:
+			template.HTMLEscape(&buf, []byte{s[i+1]})
+			i += 2
+			continue
+		
+		case c == '`':
+			n := len(s[i:]) - len(strings.TrimLeft(s[i:], "`"))
+			fence := s[i : i+n]
+			if k := strings.Index(s[i+n:], fence); k >= 0 {
+				buf.WriteString("<code>")
+				template.HTMLEscape(&buf, []byte(strings.TrimSpace(s[i+n:i+n+k])))
+				buf.WriteString("</code>")
+				i += n + k + n
+			} else {
+				buf.WriteString(fence)
+				i += n
+			}
+			continue
+		
+		case c == '!' && i+1 < len(s) && s[i+1] == '[':
+			if text, u, end, ok := r.parseLink(s, i+1); ok {
+				r.links.writeImage(&buf, u, text)
+				i = end
+				continue
+			}
+		
+		case c == '[':
+			if text, u, end, ok := r.parseLink(s, i); ok {
+				r.links.writeLink(&buf, u, r.inline(text))
+				i = end
+				continue
+			}
+		
+		case c == '<':
+			if m := mdAutoRe.FindStringSubmatch(s[i:]); m != nil {
+				r.links.writeLink(&buf, m[1], template.HTMLEscapeString(m[1]))
+				i += len(m[0])
+				continue
+			}
+		
+		case c == 'h' && isURLStart(s, i):
+			end := bareURLEnd(s, i)
+			r.links.writeLink(&buf, s[i:end], template.HTMLEscapeString(s[i:end]))
+			i = end
+			continue
+		
+		case c == '*' || c == '_':
+			for _, delim := range []string{strings.Repeat(string(c), 2), string(c)} {
+				if !strings.HasPrefix(s[i:], delim) {
+					continue
+				}
+				if j := emphasisEnd(s, i, delim); j >= 0 {
+					tag := "em"
+					if len(delim) == 2 {
+						tag = "strong"
+					}
+					buf.WriteString("<" + tag + ">" + r.inline(s[i+len(delim):j]) +
+						"</" + tag + ">")
+					i = j + len(delim)
+					c = 0
+					break
+				}
+			}
+			if c == 0 {
+				continue
+			}
+		}
+		template.HTMLEscape(&buf, []byte{c})
+		i++
+	}
+	return buf.String()
+}
+
+var (
+	rstDirectiveRe = regexp.MustCompile(`^\.\.[ \t]+([\w-]+)::[ \t]*(.*)$`)
+	rstTargetRe    = regexp.MustCompile("^\\.\\.[ \\t]+_`?([^:`]+)`?:[ \\t]*(\\S*)$")
+	rstListRe      = regexp.MustCompile(`^([-*+]|\d+[.)]|#[.)])[ \t]+`)
+	rstRefRe       = regexp.MustCompile("^`([^`]+?)(?:[ \\t\\n]*<([^<>]+)>)?`__?")
+	rstRoleRe      = regexp.MustCompile("^:([\\w-]+):`([^`]+)`")
+)
+
+// rstRenderer renders reStructuredText.
+type rstRenderer struct {
+	links readmeLinks
+	// hyperlink targets by lower-case names
+	targets map[string]string
+	// the adornment characters of section levels in the order seen
+	levels []byte
+	tight  bool
+	buf    bytes.Buffer
+}
+
+func (r *rstRenderer) render(lines []string) {
+	for _, line := range lines {
+		if m := rstTargetRe.FindStringSubmatch(line); m != nil {
+			r.targets[strings.ToLower(strings.TrimSpace(m[1]))] = m[2]
+		}
+	}
+	r.blocks(lines)
+}
+
+// adornment returns the character of a section adornment line, 0 if not one.
+func adornment(line string) byte {
+	line = strings.TrimRight(line, " ")
+	if len(line) < 2 || strings.IndexByte("=-~^\"'`#*+:._", line[0]) < 0 ||
+		strings.Trim(line, line[:1]) != "" {
+		return 0
+	}
+	return line[0]
+}
+
+// indentedBlock returns the lines, dedented, of the block indented from
+// lines[i] on, skipping leading blank lines, and the index after it.
+func indentedBlock(lines []string, i int) ([]string, int) {
+	for i < len(lines) && isBlank(lines[i]) {
+		i++
+	}
+	if i >= len(lines) || indentOf(lines[i]) == 0 {
+		return nil, i
+	}
+	w := indentOf(lines[i])
+	var block []string
+	for ; i < len(lines) && (isBlank(lines[i]) || indentOf(lines[i]) > 0); i++ {
+		block = append(block, dedent(lines[i], w))
+	}
+	for len(block) > 0 && isBlank(block[len(block)-1]) {
+		block = block[:len(block)-1]
+	}
+	return block, i
+}
+
+func (r *rstRenderer) heading(c byte, text string) {
+	level := bytes.IndexByte(r.levels, c)
+	if level < 0 {
+		r.levels = append(r.levels, c)
+		level = len(r.levels) - 1
+	}
+	tag := headingTag(level + 1)
+	r.buf.WriteString("<" + tag + ">" + r.inline(text) + "</" + tag + ">\n")
+}
+
+func (r *rstRenderer) blocks(lines []string) {
+	// the next indented block is a literal block
+	literal := false
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		switch {
+		case isBlank(line):
+			i++
+			continue
+		
+		case indentOf(line) > 0:
+			var block []string
+			block, i = indentedBlock(lines, i)
+			if literal {
+				writeCode(&r.buf, strings.Join(block, "\n"), "")
+			} else {
+				r.buf.WriteString("<blockquote>\n")
+				r.blocks(block)
+				r.buf.WriteString("</blockquote>\n")
+			}
+		
+		case adornment(line) != 0 && i+2 < len(lines) && !isBlank(lines[i+1]) &&
+				adornment(lines[i+2]) == adornment(line):
+			// a title with an overline
+			r.heading(adornment(line), strings.TrimSpace(lines[i+1]))
+			i += 3
+		
+		case i+1 < len(lines) && adornment(lines[i+1]) != 0 &&
+				len(strings.TrimSpace(lines[i+1])) >= len(strings.TrimSpace(line)):
+			r.heading(adornment(lines[i+1]), strings.TrimSpace(line))
+			i += 2
+		
+		case strings.HasPrefix(line, ".."):
+			i = r.explicit(lines, i)
+		
+		case rstListRe.MatchString(line):
+			i = r.list(lines, i)
+		
+		default:
+			para := []string{line}
+			for i++; i < len(lines) && !isBlank(lines[i]) && indentOf(lines[i]) == 0; i++ {
+				para = append(para, lines[i])
+			}
+			r.paragraph(para)
+			literal = strings.HasSuffix(strings.TrimSpace(para[len(para)-1]), "::")
+			continue
+		}
+		literal = false
+	}
+}
+
+// paragraph renders a paragraph, or the lines of a table as they are.
+func (r *rstRenderer) paragraph(para []string) {
+	first := strings.TrimSpace(para[0])
+	if strings.HasPrefix(first, "+-") || strings.HasPrefix(first, "===") {
+		writeCode(&r.buf, strings.Join(para, "\n"), "")
+		return
+	}
+	
+	text := strings.Join(para, "\n")
+	switch {
+	case strings.TrimSpace(text) == "::":
+		return
+	case strings.HasSuffix(text, " ::"):
+		text = strings.TrimSuffix(text, " ::")
+	case strings.HasSuffix(text, "::"):
+		text = strings.TrimSuffix(text, ":")
+	}
+	if r.tight {
+		r.buf.WriteString(r.inline(text) + "\n")
+	} else {
+		r.buf.WriteString("<p>" + r.inline(text) + "</p>\n")
+	}
+}
+
+// explicit renders the directive, target or comment at lines[i], returning the
+// index after it.
+func (r *rstRenderer) explicit(lines []string, i int) int {
+	m := rstDirectiveRe.FindStringSubmatch(lines[i])
+	block, end := indentedBlock(lines, i+1)
+	if m == nil {
+		// targets and comments
+		return end
+	}
+	
+	// options of the directive come first
+	var body []string
+	for j, line := range block {
+		if !strings.HasPrefix(line, ":") {
+			body = block[j:]
+			break
+		}
+	}
+	switch name, arg := strings.ToLower(m[1]), strings.TrimSpace(m[2]); name {
+	case "code", "code-block", "sourcecode":
+		for len(body) > 0 && isBlank(body[0]) {
+			body = body[1:]
+		}
+		writeCode(&r.buf, strings.Join(body, "\n"), arg)
+	case "image", "figure":
+		alt := ""
+		for _, line := range block {
+			if strings.HasPrefix(line, ":alt:") {
+				alt = strings.TrimSpace(strings.TrimPrefix(line, ":alt:"))
+			}
+		}
+		r.links.writeImage(&r.buf, arg, alt)
+		r.buf.WriteString("\n")
+	case "note", "tip", "warning", "important", "caution", "attention", "hint":
+		r.buf.WriteString("<blockquote>\n<p><strong>" + strings.Title(name) +
+			"</strong></p>\n")
+		if arg != "" {
+			body = append([]string{arg, ""}, body...)
+		}
+		r.blocks(body)
+		r.buf.WriteString("</blockquote>\n")
+	}
+	return end
+}
+
+// list renders the list starting at lines[i], returning the index after it.
+func (r *rstRenderer) list(lines []string, i int) int {
+	ordered := !strings.ContainsAny(rstListRe.FindString(lines[i])[:1], "-*+")
+	var items [][]string
+	loose := false
+	for i < len(lines) {
+		m := rstListRe.FindString(lines[i])
+		if m == "" || strings.ContainsAny(m[:1], "-*+") == ordered {
+			break
+		}
+		item := []string{lines[i][len(m):]}
+		var block []string
+		j := i + 1
+		for j < len(lines) && !isBlank(lines[j]) && indentOf(lines[j]) == 0 &&
+				!rstListRe.MatchString(lines[j]) {
+			// continuation lines of the first paragraph
+			item = append(item, lines[j])
+			j++
+		}
+		if block, j = indentedBlock(lines, j); len(block) > 0 {
+			item = append(append(item, ""), block...)
+			loose = true
+		}
+		items = append(items, item)
+		for i = j; i < len(lines) && isBlank(lines[i]); i++ {
+		}
+		if i > j && i < len(lines) && rstListRe.MatchString(lines[i]) {
+			loose = true
+		}
+	}
+	
+	tag := "ul"
+	if ordered {
+		tag = "ol"
+	}
+	tight := r.tight
+	r.tight = !loose
+	r.buf.WriteString("<" + tag + ">\n")
+	for _, item := range items {
+		r.buf.WriteString("<li>")
+		r.blocks(item)
+		r.buf.WriteString("</li>\n")
+	}
+	r.buf.WriteString("</" + tag + ">\n")
+	r.tight = tight
+	return i
+}
+
+// inline returns the HTML of the inline reST s.
+func (r *rstRenderer) inline(s string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s):
+			template.HTMLEscape(&buf, []byte{s[i+1]})
+			i += 2
+			continue
+		
+		case strings.HasPrefix(s[i:], "``"):
+			if k := strings.Index(s[i+2:], "``"); k >= 0 {
+				buf.WriteString("<code>")
+				template.HTMLEscape(&buf, []byte(s[i+2:i+2+k]))
+				buf.WriteString("</code>")
+				i += k + 4
+				continue
+			}
+		
+		case c == '`':
+			if m := rstRefRe.FindStringSubmatch(s[i:]); m != nil {
+				text, u := strings.TrimSpace(m[1]), m[2]
+				if u == "" {
+					u = r.targets[strings.ToLower(text)]
+				}
+				if u == "" {
+					template.HTMLEscape(&buf, []byte(text))
+				} else {
+					r.links.writeLink(&buf, u, template.HTMLEscapeString(text))
+				}
+				i += len(m[0])
+				continue
+			}
+			if k := strings.IndexByte(s[i+1:], '`'); k > 0 {
+				buf.WriteString("<em>")
+				template.HTMLEscape(&buf, []byte(s[i+1:i+1+k]))
+				buf.WriteString("</em>")
+				i += k + 2
+				continue
+			}
+		
+		case c == ':':
+			if m := rstRoleRe.FindStringSubmatch(s[i:]); m != nil {
+				if m[1] == "code" || m[1] == "literal" {
+					buf.WriteString("<code>")
+					template.HTMLEscape(&buf, []byte(m[2]))
+					buf.WriteString("</code>")
+				} else {
+					template.HTMLEscape(&buf, []byte(m[2]))
+				}
+				i += len(m[0])
+				continue
+			}
+		
+		case c == 'h' && isURLStart(s, i):
+			end := bareURLEnd(s, i)
+			r.links.writeLink(&buf, s[i:end], template.HTMLEscapeString(s[i:end]))
+			i = end
+			continue
+		
+		case c == '*' && (i == 0 || !isWordRune(rune(s[i-1]))):
+			delim := "*"
+			if strings.HasPrefix(s[i:], "**") {
+				delim = "**"
+			}
+			if k := strings.Index(s[i+len(delim):], delim); k > 0 {
+				tag := "em"
+				if delim == "**" {
+					tag = "strong"
+				}
+				buf.WriteString("<" + tag + ">")
+				template.HTMLEscape(&buf, []byte(s[i+len(delim):i+len(delim)+k]))
+				buf.WriteString("</" + tag + ">")
+				i += k + 2*len(delim)
+				continue
+			}
+		}
+		template.HTMLEscape(&buf, []byte{c})
+		i++
+	}
+	return buf.String()
+}
@@ -0,0 +1,175 @@
+package gocode
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"github.com/daviddengcn/go-code-crawl"
+	"github.com/daviddengcn/go-villa"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Redirect maps an old import path, the id of the entity, to the new one of
+// a moved or renamed package.
+type Redirect struct {
+	To   string
+	Time time.Time `datastore:",noindex"`
+}
+
+// maximum number of redirects followed before giving up
+const maxRedirects = 5
+
+// resolveRedirect returns the import path pkg was moved to, following chained
+// redirects. Returns pkg itself if it was not moved.
+func resolveRedirect(c appengine.Context, pkg string) string {
+	ddb := NewCachedDocDB(c, kindRedirect)
+	for i := 0; i < maxRedirects; i++ {
+		var rd Redirect
+		err, exists := ddb.Get(pkg, &rd)
+		if err != nil {
+			c.Errorf("Get(%s, %s) failed: %v", kindRedirect, pkg, err)
+			return pkg
+		}
+		if !exists || rd.To == "" {
+			return pkg
+		}
+		pkg = rd.To
+	}
+	return pkg
+}
+
+// movedPath returns the path q was moved to if q is a redirected import path,
+// "" otherwise.
+func movedPath(c appengine.Context, q string) string {
+	if !strings.Contains(q, "/") || strings.ContainsAny(q, " \t") {
+		return ""
+	}
+	if to := resolveRedirect(c, q); to != q {
+		return to
+	}
+	return ""
+}
+
+// movedPerson returns the id of the person the packages of person id were
+// moved to, "" if not moved.
+func movedPerson(c appengine.Context, id string) string {
+	site, username := gcc.ParsePersonId(id)
+	if site == "" || username == "" {
+		return ""
+	}
+	// redirects of paths in [site/username/, site/username0)
+	prefix := site + "/" + username + "/"
+	end := prefix[:len(prefix)-1] + "0"
+	var rds []Redirect
+	_, err := datastore.NewQuery(kindRedirect).
+		Filter("__key__ >=", datastore.NewKey(c, kindRedirect, prefix, 0, nil)).
+		Filter("__key__ <", datastore.NewKey(c, kindRedirect, end, 0, nil)).
+		Limit(1).GetAll(c, &rds)
+	if err != nil {
+		c.Errorf("Query %s of %s failed: %v", kindRedirect, prefix, err)
+		return ""
+	}
+	if len(rds) == 0 {
+		return ""
+	}
+	if to := personOfPackage(resolveRedirect(c, rds[0].To)); to != id {
+		return to
+	}
+	return ""
+}
+
+// redirectsTo returns the old import paths redirected to pkg.
+func redirectsTo(c appengine.Context, pkg string) []string {
+	q := datastore.NewQuery(kindRedirect).Filter("To=", pkg).KeysOnly()
+	keys, err := q.GetAll(c, nil)
+	if err != nil {
+		c.Errorf("Query %s to %s failed: %v", kindRedirect, pkg, err)
+		return nil
+	}
+	
+	olds := make([]string, len(keys))
+	for i, key := range keys {
+		olds[i] = key.StringID()
+	}
+	return olds
+}
+
+// importedPackages returns the packages importing pkg, including those still
+// importing the old paths redirected to pkg.
+func importedPackages(c appengine.Context, pkg string) ([]string, error) {
+	ts := NewTokenSet(c, prefixImports)
+	importedPkgs, err := ts.Search(fieldImports, villa.NewStrSet(pkg))
+	if err != nil {
+		return nil, err
+	}
+	
+	olds := redirectsTo(c, pkg)
+	if len(olds) == 0 {
+		return importedPkgs, nil
+	}
+	
+	pkgs := villa.NewStrSet(importedPkgs...)
+	for _, old := range olds {
+		oldPkgs, err := ts.Search(fieldImports, villa.NewStrSet(old))
+		if err != nil {
+			return nil, err
+		}
+		pkgs.Put(oldPkgs...)
+	}
+	// a package importing both paths or moved itself counts only once
+	pkgs.Delete(pkg)
+	
+	importedPkgs = pkgs.Elements()
+	sort.Strings(importedPkgs)
+	return importedPkgs, nil
+}
+
+// movePackage redirects from to to. The old package is removed from
+// searching, and the new one is scheduled to crawl and to update its
+// importers.
+func movePackage(c appengine.Context, from, to string) {
+	if from == to || to == "" {
+		return
+	}
+	if resolveRedirect(c, to) == from {
+		// moved back, the old redirect is no longer valid
+		clearRedirect(c, to)
+	}
+	
+	ddb := NewCachedDocDB(c, kindRedirect)
+	if err := ddb.Put(from, &Redirect{To: to, Time: time.Now()}); err != nil {
+		c.Errorf("Put(%s, %s) failed: %v", kindRedirect, from, err)
+		return
+	}
+	
+	// collapse chains so that redirectsTo(to) finds all the old paths
+	for _, old := range redirectsTo(c, from) {
+		if err := ddb.Put(old, &Redirect{To: to, Time: time.Now()}); err != nil {
+			c.Errorf("Put(%s, %s) failed: %v", kindRedirect, old, err)
+		}
+	}
+	
+	deletePackage(c, from)
+	appendPackage(c, to)
+	
+	if err := NewDocDB(c, kindToUpdate).Put(to, &struct{}{}); err != nil {
+		c.Errorf("Put(%s, %s) failed: %v", kindToUpdate, to, err)
+	}
+	
+	c.Infof("Package %s moved to %s", from, to)
+}
+
+// clearRedirect removes the redirect of pkg, if any, e.g. when pkg is crawled
+// successfully again.
+func clearRedirect(c appengine.Context, pkg string) {
+	ddb := NewCachedDocDB(c, kindRedirect)
+	var rd Redirect
+	if _, exists := ddb.Get(pkg, &rd); !exists {
+		return
+	}
+	
+	if err := ddb.Delete(pkg); err != nil {
+		c.Errorf("Delete(%s, %s) failed: %v", kindRedirect, pkg, err)
+	}
+}
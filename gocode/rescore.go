@@ -0,0 +1,103 @@
+package gocode
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"math"
+	"time"
+)
+
+// Static scores change without recrawling: freshness decays with time and the
+// quality weights may be edited. rescoreDocs sweeps kindDocDB in passes,
+// continuing from a saved cursor, and queues the documents whose StaticScore
+// has drifted in kindToUpdate, which processes and reindexes them.
+const (
+	rescoreStateID = "state"
+
+	// the relative change of the static score for a document to be rescored
+	maxStaticDrift = 0.01
+)
+
+type RescoreState struct {
+	Cursor string `datastore:",noindex"`
+}
+
+// restartRescore makes the sweep start over from the first document.
+func restartRescore(c appengine.Context) error {
+	return NewDocDB(c, kindRescoreState).Put(rescoreStateID, &RescoreState{})
+}
+
+// staticDrifted returns whether the StaticScore of d differs from the current
+// static score s.
+func staticDrifted(d *DocInfo, s float64) bool {
+	return math.Abs(s-d.StaticScore) > maxStaticDrift*math.Abs(d.StaticScore)
+}
+
+// rescoreDocs continues the sweep of documents for at most ttl. Returns the
+// number of documents checked and queued.
+func rescoreDocs(c appengine.Context, ttl time.Duration) (checked, queued int) {
+	start := time.Now()
+	stateDB := NewDocDB(c, kindRescoreState)
+	var state RescoreState
+	if err, _ := stateDB.Get(rescoreStateID, &state); err != nil {
+		c.Errorf("Get(%s) failed: %v", kindRescoreState, err)
+		return 0, 0
+	}
+
+	q := datastore.NewQuery(kindDocDB)
+	if state.Cursor != "" {
+		cursor, err := datastore.DecodeCursor(state.Cursor)
+		if err != nil {
+			c.Errorf("DecodeCursor failed: %v", err)
+			return 0, 0
+		}
+		q = q.Start(cursor)
+	}
+
+	qw := qualityWeights(c)
+	var drifted []string
+	t := q.Run(c)
+	done := false
+	for ; time.Now().Sub(start) < ttl; checked++ {
+		var d DocInfo
+		_, err := t.Next(&d)
+		if err == datastore.Done {
+			done = true
+			break
+		}
+		if !DocGetOk(err) {
+			c.Errorf("t.Next failed: %v", err)
+			break
+		}
+
+		if staticDrifted(&d, calcStaticRank(&d, qw)) {
+			drifted = append(drifted, d.Package)
+		}
+	}
+
+	if len(drifted) > 0 {
+		errs := NewDocDB(c, kindToUpdate).PutMulti(drifted,
+			make([]struct{}, len(drifted)))
+		if errs.ErrorCount() > 0 {
+			// check them again next pass
+			c.Errorf("PutMulti(%d packages) to %s with %d failed: %v",
+				len(drifted), kindToUpdate, errs.ErrorCount(), errs)
+			return checked, 0
+		}
+	}
+
+	if done {
+		state.Cursor = ""
+	} else {
+		cursor, err := t.Cursor()
+		if err != nil {
+			c.Errorf("t.Cursor failed: %v", err)
+			return checked, len(drifted)
+		}
+		state.Cursor = cursor.String()
+	}
+	if err := stateDB.Put(rescoreStateID, &state); err != nil {
+		c.Errorf("Put(%s) failed: %v", kindRescoreState, err)
+	}
+	return checked, len(drifted)
+}
@@ -0,0 +1,150 @@
+package gocode
+
+import (
+	"appengine"
+	"appengine/memcache"
+	"crypto/sha1"
+	"fmt"
+	"github.com/daviddengcn/go-villa"
+	"time"
+)
+
+// Ranked results are cached in memcache by the normalized query, filters and
+// sort order, together with the index generation. Any change of the index
+// bumps the generation, so results cached before are never read again and
+// expire in time.
+const (
+	indexGenerationKey = "gen:index"
+	
+	searchCacheExpiration = time.Hour
+)
+
+// CachedHit is an entry of cached results, without its DocInfo.
+type CachedHit struct {
+	Package     string
+	StaticScore float64
+	Subs        []*DocRow
+	Forks       []*DocRow
+}
+
+// CachedResult is the ranked ids of the first K entries of a search.
+type CachedResult struct {
+	K            int
+	TotalResults int
+	TotalEntries int
+	Folded       int
+	Forks        int
+	Partial      bool
+	Facets       []Facet
+	// the tokens to mark
+	Tokens []string
+	Hits   []CachedHit
+}
+
+// indexGeneration returns the current generation of the index. A missing
+// generation starts from the current time so that it never repeats an
+// evicted one.
+func indexGeneration(c appengine.Context) uint64 {
+	gen, err := memcache.Increment(c, indexGenerationKey, 0,
+		uint64(time.Now().UnixNano()))
+	if err != nil {
+		c.Errorf("Get %s failed: %v", indexGenerationKey, err)
+	}
+	return gen
+}
+
+// bumpIndexGeneration invalidates all cached results.
+func bumpIndexGeneration(c appengine.Context) {
+	_, err := memcache.Increment(c, indexGenerationKey, 1,
+		uint64(time.Now().UnixNano()))
+	if err != nil {
+		c.Errorf("Bump %s failed: %v", indexGenerationKey, err)
+	}
+}
+
+func searchCacheKey(gen uint64, q string, opts SearchOptions) string {
+	h := sha1.Sum([]byte(normQuery(q) + "\x00" + string(opts.Params())))
+	return fmt.Sprintf("%s%d:%x", prefixSearchResult, gen, h)
+}
+
+// cachedSearch is search with the ranked results cached. Results of fewer than
+// k entries are computed again, with a larger k for the next pages.
+func cachedSearch(c appengine.Context, q string, opts SearchOptions, k int) (
+		*SearchResult, villa.StrSet, error) {
+	key := searchCacheKey(indexGeneration(c), q, opts)
+	
+	var cr CachedResult
+	if _, err := memcache.Gob.Get(c, key, &cr); err == nil &&
+			(cr.K >= k || !cr.Partial && len(cr.Hits) == cr.TotalEntries) {
+		c.Infof("Results of %s from cache", q)
+		return cachedResults(c, &cr, q, k), villa.NewStrSet(cr.Tokens...), nil
+	}
+	
+	if k < 2*itemsPerPage {
+		k = 2 * itemsPerPage
+	}
+	results, tokens, err := search(c, q, opts, k)
+	if err != nil {
+		return nil, nil, err
+	}
+	
+	cr = CachedResult{
+		K:            k,
+		TotalResults: results.TotalResults,
+		TotalEntries: results.TotalEntries,
+		Folded:       results.Folded,
+		Forks:        results.Forks,
+		Partial:      results.Partial,
+		Facets:       results.Facets,
+		Tokens:       tokens.Elements(),
+	}
+	for _, hit := range results.Hits {
+		cr.Hits = append(cr.Hits, CachedHit{
+			Package:     hit.Doc.Package,
+			StaticScore: hit.Doc.StaticScore,
+			Subs:        hit.Subs,
+			Forks:       hit.Forks,
+		})
+	}
+	if err := memcache.Gob.Set(c, &memcache.Item{
+		Key:        key,
+		Object:     &cr,
+		Expiration: searchCacheExpiration,
+	}); err != nil {
+		c.Errorf("Caching results of %s failed: %v", q, err)
+	}
+	
+	return results, tokens, nil
+}
+
+// cachedResults fetches and scores the DocInfos of the first k cached hits of
+// q.
+func cachedResults(c appengine.Context, cr *CachedResult, q string,
+		k int) *SearchResult {
+	hits := cr.Hits
+	if len(hits) > k {
+		hits = hits[:k]
+	}
+	entries := make([]*hitEntry, len(hits))
+	for i, hit := range hits {
+		entries[i] = &hitEntry{
+			row: &DocRow{
+				Package:    hit.Package,
+				IndexEntry: IndexEntry{StaticScore: hit.StaticScore},
+			},
+			subs:  hit.Subs,
+			forks: hit.Forks,
+		}
+	}
+	
+	groups := queryGroups(c, q)
+	return &SearchResult{
+		TotalResults: cr.TotalResults,
+		TotalEntries: cr.TotalEntries,
+		Folded:       cr.Folded,
+		Forks:        cr.Forks,
+		Partial:      cr.Partial,
+		Hits:         fetchHits(c, entries, groups, activeRankModel(c), nil),
+		Facets:       cr.Facets,
+	}
+}
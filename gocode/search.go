@@ -8,6 +8,7 @@ import (
 	"github.com/daviddengcn/go-villa"
 	"github.com/daviddengcn/go-index"
 	"log"
+	"math"
 	"sort"
 	"strings"
 	"time"
@@ -15,9 +16,24 @@ import (
 	"regexp"
 )
 
+// SearchResult are the results of a search. If not all matched documents are
+// read, Partial is true and the totals and facets count the documents read.
 type SearchResult struct {
+	// the number of matched documents
 	TotalResults int
-	Docs         []*DocInfo
+	// the number of entries after folding sub-packages and collapsing forks
+	TotalEntries int
+	Folded       int
+	Forks        int
+	Partial      bool
+	// the top entries requested
+	Hits []*SearchHit
+	// a corrected query if some words were misspelled
+	Suggestion string
+	// true if Docs are the results of Suggestion instead of the query
+	Corrected bool
+	// counts of facet values over the matched documents
+	Facets []Facet
 }
 
 func authorOfPackage(pkg string) string {
@@ -55,13 +71,37 @@ type DocInfo struct {
 	ProjectURL   string    `datastore:",noindex"`
 	ReadmeFn     string    `datastore:",noindex"`
 	ReadmeData   string    `datastore:",noindex"`
+	// fingerprint of the contents for detecting forks and mirrors
+	Fingerprint string `datastore:",noindex"`
+	// the package this one was forked from, reported by the crawler
+	ForkOf string `datastore:",noindex"`
+	// SPDX identifier of the license, empty if unknown
+	License string `datastore:",noindex"`
+	// authority of the author, see AuthorInfo
+	AuthorScore float64 `datastore:",noindex"`
+	// code quality, see PackageQuality
+	QualityMeasured bool    `datastore:",noindex"`
+	HasTests        bool    `datastore:",noindex"`
+	HasExamples     bool    `datastore:",noindex"`
+	DocCoverage     float64 `datastore:",noindex"`
+	VetIssues       int     `datastore:",noindex"`
+	// the time of the last commit reported by the crawler, zero if unknown
+	LastCommit time.Time `datastore:",noindex"`
+	// archived by the owner on the hosting site
+	Archived bool `datastore:",noindex"`
+	// the package doc has a "Deprecated:" paragraph
+	Deprecated bool `datastore:",noindex"`
+	// ids of the unfixed advisories affecting the package, see Advisory
+	Advisories []string `datastore:",noindex"`
+	// ids of the advisories affecting the package fixed in a later version
+	FixedAdvisories []string `datastore:",noindex"`
 
 	MatchScore float64 `datastore:"-"`
 	Score      float64 `datastore:"-"`
 }
 
-func (doc *DocInfo) updateStaticScore() {
-	doc.StaticScore = calcStaticRank(doc)
+func (doc *DocInfo) updateStaticScore(qw *QualityWeights) {
+	doc.StaticScore = calcStaticRank(doc, qw)
 }
 
 func (doc *DocInfo) loadFromDB(c appengine.Context, id string) (err error, exists bool) {
@@ -94,24 +134,35 @@ func normWord(word string) string {
 	return word
 }
 
+// isCJK returns true for runes of scripts written without spaces between
+// words.
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana,
+		unicode.Hangul)
+}
+
+func isWordRune(r rune) bool {
+	return (unicode.IsLetter(r) || unicode.IsMark(r) || unicode.IsNumber(r)) &&
+		!isCJK(r)
+}
+
+// CheckRuneType keeps words of alphabetic scripts, e.g. Latin or Cyrillic,
+// including accented letters and digits, as single tokens. A run of CJK runes
+// is also a single token, which is segmented later by cjkNGramFilter.
 func CheckRuneType(last, current rune) index.RuneType {
 	if isTermSep(current) {
 		return index.TokenSep
 	}
 
-	if current > 128 {
-		return index.TokenStart
-	}
-
-	if unicode.IsLetter(current) {
-		if unicode.IsLetter(last) {
+	if isCJK(current) {
+		if isCJK(last) {
 			return index.TokenBody
 		}
 		return index.TokenStart
 	}
 
-	if unicode.IsNumber(current) {
-		if unicode.IsNumber(last) {
+	if isWordRune(current) {
+		if isWordRune(last) {
 			return index.TokenBody
 		}
 		return index.TokenStart
@@ -120,32 +171,70 @@ func CheckRuneType(last, current rune) index.RuneType {
 	return index.TokenStart
 }
 
-func isCamel(token string) bool {
-	upper, lower := false, false
-	for _, r := range token {
-		if !unicode.IsLetter(r) {
-			return false
-		}
+func isIdentJoiner(r rune) bool {
+	return r == '.' || r == '-' || r == '_'
+}
 
-		if unicode.IsUpper(r) {
-			upper = true
-			if lower {
-				break
+// CheckIdentRuneType is CheckRuneType keeping '.', '-' and '_' inside
+// identifiers and path elements, e.g. yaml.v2, go-yaml or snake_case.
+func CheckIdentRuneType(last, current rune) index.RuneType {
+	if isIdentJoiner(current) && isWordRune(last) ||
+			isWordRune(current) && isIdentJoiner(last) {
+		return index.TokenBody
+	}
+	return CheckRuneType(last, current)
+}
+
+// CheckPathRuneType splits an import path at '/' only, so that each path
+// element, e.g. gopkg.in or yaml.v2, is a single token.
+func CheckPathRuneType(last, current rune) index.RuneType {
+	if current == '/' || unicode.IsSpace(current) {
+		return index.TokenSep
+	}
+	if last == '/' || unicode.IsSpace(last) {
+		return index.TokenStart
+	}
+	return index.TokenBody
+}
+
+// splitCamel splits a camel-case word keeping acronyms and digits in words,
+// e.g. HTTPServer2Go into HTTP, Server2 and Go.
+func splitCamel(word string) []string {
+	runes := []rune(word)
+	var words []string
+	start := 0
+	for i := 1; i < len(runes); i++ {
+		if !unicode.IsUpper(runes[i]) {
+			continue
+		}
+		
+		if unicode.IsUpper(runes[i-1]) {
+			// inside an acronym, a word starts at its last upper letter, but
+			// not for plurals like URLs
+			if i+1 == len(runes) || !unicode.IsLower(runes[i+1]) ||
+					i+2 == len(runes) && runes[i+1] == 's' {
+				continue
 			}
-		} else {
-			lower = true
 		}
+		
+		words = append(words, string(runes[start:i]))
+		start = i
 	}
+	return append(words, string(runes[start:]))
+}
 
-	return upper && lower
+func isIdentPunct(r rune) bool {
+	return !isWordRune(r) && !isCJK(r)
 }
 
-func CheckCamel(last, current rune) index.RuneType {
-	if unicode.IsUpper(current) {
-		return index.TokenStart
+// splitIdent splits an identifier or a path element into words at '.', '-',
+// '_', other punctuation and camel-case boundaries.
+func splitIdent(token string) []string {
+	var words []string
+	for _, part := range strings.FieldsFunc(token, isIdentPunct) {
+		words = append(words, splitCamel(part)...)
 	}
-
-	return index.TokenBody
+	return words
 }
 
 var patURL = regexp.MustCompile(`http[s]?://\S+`)
@@ -158,57 +247,9 @@ var stopWords = villa.NewStrSet([]string{
 	"the", "on", "in", "as",
 }...)
 
+// appendTokens appends the terms of text analyzed by textAnalyzer.
 func appendTokens(tokens villa.StrSet, text string) villa.StrSet {
-	/*
-		for _, token := range strings.FieldsFunc(text, isTermSep) {
-			token = normWord(token)
-			tokens.Put(token)
-		}
-	*/
-	
-	text = filterURLs(text)
-	
-	lastToken := ""
-	index.Tokenize(CheckRuneType, villa.NewPByteSlice([]byte(text)), func(token []byte) error {
-		tokenStr := string(token)
-		if isCamel(tokenStr) {
-			last := ""
-			index.Tokenize(CheckCamel, villa.NewPByteSlice(token), func(token []byte) error {
-				tokenStr = string(token)
-				tokenStr = normWord(tokenStr)
-				if !stopWords.In(tokenStr) {
-					tokens.Put(tokenStr)
-				}
-
-				if last != "" {
-					tokens.Put(last + "-" + string(tokenStr))
-				}
-
-				last = tokenStr
-				return nil
-			})
-		}
-		tokenStr = normWord(tokenStr)
-		if !stopWords.In(tokenStr) {
-			tokens.Put(tokenStr)
-		}
-
-		if tokenStr[0] > 128 && len(lastToken) > 0 && lastToken[0] > 128 {
-			tokens.Put(lastToken + tokenStr)
-		}
-
-		lastToken = tokenStr
-		return nil
-	})
-	/*
-		var s scanner.Scanner
-		s.Init(bytes.NewReader([]byte(text)))
-		for token := s.Scan(); token != scanner.EOF; token = s.Scan() {
-			tokens.Put(s.TokenText())
-		}
-	*/
-
-	return tokens
+	return analyzeTokens(textAnalyzer, tokens, text)
 }
 
 func matchToken(token string, text string, tokens villa.StrSet) bool {
@@ -297,106 +338,78 @@ func fetchDocs(c appengine.Context, ids []string, docs []DocInfo) {
 	}
 }
 
-func search(c appengine.Context, q string) (*SearchResult, villa.StrSet, error) {
-	ts := NewTokenSet(c, "index:")
-
-	tokens := appendTokens(nil, q)
+// search returns the first k entries of the results of q with opts.
+func search(c appengine.Context, q string, opts SearchOptions, k int) (
+		*SearchResult, villa.StrSet, error) {
+	text, filters := parseFacetQuery(q)
+	tokens := analyzeTokens(queryAnalyzer, nil, text)
 	if len(tokens) == 0 {
 		return &SearchResult{}, nil, nil
 	}
 
 	c.Infof("%d tokens for query %s", len(tokens), q)
 	
-	ids, err := ts.Search("doc", tokens)
-	if err != nil {
-		return nil, nil, err
+	groups := expandQuery(c, tokens)
+	m := opts.model
+	if m == nil {
+		m = activeRankModel(c)
 	}
-	c.Infof("%d ids got for query %s", len(ids), q)
-
-	//ddb := NewCachedDocDB(c, kindDocDB)
-
-	docs := make([]DocInfo, len(ids))
-	/*
-	for i, id := range ids {
-		err, exists := ddb.Get(id, &docs[i])
+	
+	// rows are read until the top k by relevance can't change. Other orders
+	// sort the rows read.
+	reader := newRowReader(c, groups)
+	scored := make(map[string]*DocInfo)
+	var rows []*DocRow
+	var entries []*hitEntry
+	var folded, forks int
+	var hits []*SearchHit
+	for read := 0; ; {
+		page, err := reader.next(searchPageRows)
 		if err != nil {
-			c.Errorf("  ddb.Get(%s,) failed: %v", id, err)
+			return nil, nil, err
 		}
-
-		if exists {
-			if docs[i].StaticScore < 1 {
-				docs[i].updateStaticScore()
+		read += len(page)
+		rows = append(rows, filterRows(filterFacets(page, filters), opts)...)
+		entries, folded, forks = groupRows(rows, opts.ExcludeForks)
+		
+		last := reader.done() || read >= maxSearchRows
+		if opts.Sort == sortRelevance {
+			tail := math.Inf(-1)
+			if !last {
+				tail = reader.tailBound(m, len(groups))
 			}
-
-			docs[i].MatchScore = calcMatchScore(&docs[i], tokens)
-			docs[i].Score = (docs[i].StaticScore - 0.9) * docs[i].MatchScore
-		}
-	}
-	*/
-	fetchDocs(c, ids, docs)
-	pDocs := make([]*DocInfo, 0, len(docs))
-	for i := range docs {
-		if docs[i].Package != "" {
-			docs[i].MatchScore = calcMatchScore(&docs[i], tokens)
-			docs[i].Score = (docs[i].StaticScore - 0.9) * docs[i].MatchScore
-			
-			pDocs = append(pDocs, &docs[i])
+			hits = topHits(c, entries, groups, m, k, tail, scored)
+			if last || len(hits) >= k && hits[k-1].Doc.Score >= tail {
+				break
+			}
+		} else if last {
+			hits = sortedHits(c, entries, groups, m, opts, k)
+			break
 		}
 	}
-	c.Infof("%d available docs", len(pDocs))
-
-	villa.SortF(len(pDocs), func(i, j int) bool {
-		// true if doc i is before doc j
-		ssi, ssj := pDocs[i].Score, pDocs[j].Score
-		if ssi > ssj {
-			return true
-		}
-		if ssi < ssj {
-			return false
-		}
-
-		sci, scj := pDocs[i].StarCount, pDocs[j].StarCount
-		if sci > scj {
-			return true
-		}
-		if sci < scj {
-			return false
-		}
-
-		pi, pj := pDocs[i].Package, pDocs[j].Package
-		if len(pi) < len(pj) {
-			return true
-		}
-		if len(pi) > len(pj) {
-			return false
-		}
-
-		return pi < pj
-	}, func(i, j int) {
-		// Swap
-		pDocs[i], pDocs[j] = pDocs[j], pDocs[i]
-	})
+	c.Infof("%d rows read, %d hits ranked for query %s", len(reader.seen),
+		len(hits), q)
 
-	c.Infof("Docs sorted")
 	return &SearchResult{
-		TotalResults: len(ids),
-		Docs:         pDocs,
-	}, tokens, nil
+		TotalResults: len(rows),
+		TotalEntries: len(entries),
+		Folded:       folded,
+		Forks:        forks,
+		Partial:      !reader.done(),
+		Hits:         hits,
+		Facets:       countFacets(rows, q, filters),
+	}, groupsTokens(groups), nil
 }
 
 func doIndex(c appengine.Context, doc *DocInfo) error {
 	ts := NewTokenSet(c, prefixIndex)
-	var tokens villa.StrSet
-	tokens = appendTokens(tokens, doc.Name)
-	tokens = appendTokens(tokens, doc.Package)
-	tokens = appendTokens(tokens, doc.Description)
-	tokens = appendTokens(tokens, doc.ReadmeData)
-	tokens = appendTokens(tokens, doc.Author)
+	ent := indexEntryOf(doc)
+	raiseIndexMaxima(ent)
 
 	id := doc.Package
 
-	log.Printf("  indexing %s, %v", id, tokens)
-	err := ts.Index(fieldIndex, id, tokens)
+	log.Printf("  indexing %s, %v", id, ent.Tokens)
+	err := ts.Put(fieldIndex, id, ent)
 	if err != nil {
 		return err
 	}
@@ -406,10 +419,53 @@ func doIndex(c appengine.Context, doc *DocInfo) error {
 	if err != nil {
 		return err
 	}
+	bumpIndexGeneration(c)
+	
+	indexSuggestions(c, doc)
 
 	return nil
 }
 
+// reindexDocs rewrites the index entries of the documents in kindDocDB from
+// cursor for at most ttl, so that their summaries are filled. It returns the
+// cursor to continue from, "" if done, when the summaries are projected.
+func reindexDocs(c appengine.Context, cursor string, ttl time.Duration) (
+		next string, cnt int, err error) {
+	start := time.Now()
+	q := datastore.NewQuery(kindDocDB)
+	if cursor != "" {
+		cur, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return "", 0, err
+		}
+		q = q.Start(cur)
+	}
+	
+	ts := NewTokenSet(c, prefixIndex)
+	t := q.Run(c)
+	for time.Now().Sub(start) < ttl {
+		var d DocInfo
+		_, err := t.Next(&d)
+		if err == datastore.Done {
+			return "", cnt, saveIndexVersion(c, indexVersion)
+		}
+		if !DocGetOk(err) {
+			return "", cnt, err
+		}
+		
+		if err := ts.Put(fieldIndex, d.Package, indexEntryOf(&d)); err != nil {
+			return "", cnt, err
+		}
+		cnt++
+	}
+	
+	cur, err := t.Cursor()
+	if err != nil {
+		return "", cnt, err
+	}
+	return cur.String(), cnt, nil
+}
+
 func updateImported(c appengine.Context, pkg string) {
 	log.Printf("  updateImported of %s ...", pkg)
 	var doc DocInfo
@@ -422,10 +478,9 @@ func updateImported(c appengine.Context, pkg string) {
 		return
 	}
 
-	ts := NewTokenSet(c, "import:")
-	importedPkgs, err := ts.Search("import", villa.NewStrSet(pkg))
+	importedPkgs, err := importedPackages(c, pkg)
 	if err != nil {
-		log.Printf("  [updateImported] ts.Search(%s) failed: %v", pkg, err)
+		log.Printf("  [updateImported] importedPackages(%s) failed: %v", pkg, err)
 		return
 	}
 
@@ -435,12 +490,22 @@ func updateImported(c appengine.Context, pkg string) {
 	}
 	sort.Strings(importedPkgs)
 	doc.ImportedPkgs = importedPkgs
-	doc.updateStaticScore()
+	doc.AuthorScore = authorScore(c, pkg)
+	doc.updateStaticScore(qualityWeights(c))
 
 	err = doc.saveToDB(c)
 	if err != nil {
 		log.Printf("  [updateImported] ddb.Put(%s) failed: %v", pkg, err)
+		return
+	}
+	
+	// keep the summary in the index entry up to date
+	err = NewTokenSet(c, prefixIndex).Put(fieldIndex, pkg, indexEntryOf(&doc))
+	if err != nil {
+		log.Printf("  [updateImported] index %s failed: %v", pkg, err)
+		return
 	}
+	bumpIndexGeneration(c)
 }
 
 func diffStringList(l1, l2 []string) (diff []string) {
@@ -484,28 +549,34 @@ func processDocument(c appengine.Context, d *DocInfo) error {
 		d.StarCount = 0
 	}
 
-	// get imported packages
-	ts := NewTokenSet(c, prefixImports)
-	importedPkgs, err := ts.Search(fieldImports, villa.NewStrSet(pkg))
+	// get imported packages, including those of the old paths if moved
+	importedPkgs, err := importedPackages(c, pkg)
 	if err != nil {
 		return err
 	}
 	d.ImportedPkgs = importedPkgs
 	
 	// index imports
+	ts := NewTokenSet(c, prefixImports)
 	err = ts.Index(fieldImports, pkg, villa.NewStrSet(d.Imports...))
 	if err != nil {
 		return err
 	}
 	
 	// update static score and index it
-	d.updateStaticScore()
+	d.AuthorScore = authorScore(c, pkg)
+	d.Advisories, d.FixedAdvisories = advisoriesOf(c, pkg)
+	d.updateStaticScore(qualityWeights(c))
 	err = doIndex(c, d)
 	if err != nil {
 		return err
 	}
 	
 	pkgs := diffStringList(savedD.Imports, d.Imports)
+	for i, pkg := range pkgs {
+		// importing an old path counts for the new one
+		pkgs[i] = resolveRedirect(c, pkg)
+	}
 	if len(pkgs) > 0 {
 		ddb := NewDocDB(c, kindToUpdate)
 		errs := ddb.PutMulti(pkgs, make([]struct{}, len(pkgs)))
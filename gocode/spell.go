@@ -0,0 +1,522 @@
+package gocode
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"github.com/daviddengcn/go-villa"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The spelling dictionary holds the document frequencies of the terms of the
+// token index. It is sharded by the lengths of terms, so the candidates of a
+// term are in the shards of lengths within maxEdits of it, and rebuilt by
+// buildSpellDict in passes over kindIndex, continuing from a saved cursor. A
+// shard too large for one entity is split into parts.
+const (
+	spellStateID = "state"
+	// the version of the sharding, a build of another one is restarted
+	spellDictVersion = 2
+	
+	// the terms of a part of a shard, keeping it below the 1 MB entity limit
+	maxSpellPartTerms = 20000
+	
+	// a query word with fewer documents than this is checked for corrections
+	minSpellHits = 3
+	// a correction must be at least this times more frequent than the word
+	minSpellGain = 5
+)
+
+type SpellShard struct {
+	Terms  []string `datastore:",noindex"`
+	Counts []int    `datastore:",noindex"`
+	// the number of parts of a split shard, stored under spellPartID
+	Parts int `datastore:",noindex"`
+}
+
+func (sh *SpellShard) toMap() map[string]int {
+	m := make(map[string]int, len(sh.Terms))
+	for i, term := range sh.Terms {
+		if i < len(sh.Counts) {
+			m[term] = sh.Counts[i]
+		}
+	}
+	return m
+}
+
+func spellShardFromMap(m map[string]int) *SpellShard {
+	sh := &SpellShard{
+		Terms:  make([]string, 0, len(m)),
+		Counts: make([]int, 0, len(m)),
+	}
+	for term, cnt := range m {
+		sh.Terms = append(sh.Terms, term)
+		sh.Counts = append(sh.Counts, cnt)
+	}
+	return sh
+}
+
+type SpellState struct {
+	Cursor  string    `datastore:",noindex"`
+	Started time.Time `datastore:",noindex"`
+	Version int       `datastore:",noindex"`
+}
+
+// spellable returns true for words of ASCII letters and digits which are
+// checked for spelling.
+func spellable(word string) bool {
+	if len(word) < 3 || len(word) > 24 {
+		return false
+	}
+	hasLetter := false
+	for _, r := range word {
+		switch {
+		case r >= 'a' && r <= 'z':
+			hasLetter = true
+		case r >= '0' && r <= '9':
+		default:
+			return false
+		}
+	}
+	return hasLetter
+}
+
+// spellShardOf returns the shard of a spellable term, which is ASCII.
+func spellShardOf(term string) string {
+	return strconv.Itoa(len(term))
+}
+
+// spellPartID returns the ID of the i-th part of the shard id. The first part
+// is stored under id itself.
+func spellPartID(id string, i int) string {
+	if i == 0 {
+		return id
+	}
+	return id + "/" + strconv.Itoa(i)
+}
+
+type spellShardDB interface {
+	Get(id string, doc interface{}) (err error, exists bool)
+	Put(id string, doc interface{}) error
+}
+
+// getSpellShard returns the counts of the shard id with all its parts.
+func getSpellShard(db spellShardDB, id string) (map[string]int, error) {
+	var sh SpellShard
+	if err, _ := db.Get(id, &sh); err != nil {
+		return sh.toMap(), err
+	}
+	m := sh.toMap()
+	for i := 1; i < sh.Parts; i++ {
+		var part SpellShard
+		if err, _ := db.Get(spellPartID(id, i), &part); err != nil {
+			return m, err
+		}
+		for term, cnt := range part.toMap() {
+			m[term] = cnt
+		}
+	}
+	return m, nil
+}
+
+// putSpellShard saves the counts of the shard id, split into parts of at most
+// maxSpellPartTerms terms. Returns the number of parts.
+func putSpellShard(db spellShardDB, id string, m map[string]int) (int, error) {
+	sh := spellShardFromMap(m)
+	parts := (len(sh.Terms) + maxSpellPartTerms - 1) / maxSpellPartTerms
+	if parts == 0 {
+		parts = 1
+	}
+	for i := parts - 1; i >= 0; i-- {
+		// the first part, referring to the others, goes last
+		part := &SpellShard{}
+		if i == 0 {
+			part.Parts = parts
+		}
+		from, to := i*maxSpellPartTerms, (i+1)*maxSpellPartTerms
+		if to > len(sh.Terms) {
+			to = len(sh.Terms)
+		}
+		part.Terms, part.Counts = sh.Terms[from:to], sh.Counts[from:to]
+		if err := db.Put(spellPartID(id, i), part); err != nil {
+			return 0, err
+		}
+	}
+	return parts, nil
+}
+
+// spellTerms returns the spellable terms of an index entry.
+func spellTerms(ent *IndexEntry) villa.StrSet {
+	var terms villa.StrSet
+	for _, token := range ent.Tokens {
+		if spellable(token) {
+			terms.Put(token)
+		}
+	}
+	return terms
+}
+
+// buildSpellDict continues building the spelling dictionary for at most ttl,
+// and replaces the live one when all documents are counted. Returns the number
+// of documents processed.
+func buildSpellDict(c appengine.Context, ttl time.Duration) int {
+	start := time.Now()
+	stateDB := NewDocDB(c, kindSpellState)
+	var state SpellState
+	if err, _ := stateDB.Get(spellStateID, &state); err != nil {
+		c.Errorf("Get(%s) failed: %v", kindSpellState, err)
+		return 0
+	}
+	
+	if state.Version != spellDictVersion {
+		// drop the shards counted with another sharding
+		buildKeys, err := datastore.NewQuery(kindSpellBuild).KeysOnly().GetAll(c, nil)
+		if err != nil {
+			c.Errorf("Query %s failed: %v", kindSpellBuild, err)
+			return 0
+		}
+		if err := datastore.DeleteMulti(c, buildKeys); err != nil {
+			c.Errorf("Clearing %s failed: %v", kindSpellBuild, err)
+			return 0
+		}
+		state = SpellState{Version: spellDictVersion}
+	}
+	
+	q := datastore.NewQuery(kindIndex)
+	if state.Cursor != "" {
+		cursor, err := datastore.DecodeCursor(state.Cursor)
+		if err != nil {
+			c.Errorf("DecodeCursor failed: %v", err)
+			return 0
+		}
+		q = q.Start(cursor)
+	} else {
+		state.Started = start
+	}
+	
+	buildDB := NewDocDB(c, kindSpellBuild)
+	shards := make(map[string]map[string]int)
+	getShard := func(id string) map[string]int {
+		if m, ok := shards[id]; ok {
+			return m
+		}
+		m := make(map[string]int)
+		if state.Cursor != "" {
+			// continue the counts of previous runs
+			var err error
+			if m, err = getSpellShard(buildDB, id); err != nil {
+				c.Errorf("Get(%s, %s) failed: %v", kindSpellBuild, id, err)
+			}
+		}
+		shards[id] = m
+		return m
+	}
+	
+	t := q.Run(c)
+	i, done := 0, false
+	for ; ; i++ {
+		if time.Now().Sub(start) > ttl {
+			c.Infof("%v elapsed, quit with %d entries processed", ttl, i)
+			break
+		}
+		
+		var ent IndexEntry
+		_, err := t.Next(&ent)
+		if err == datastore.Done {
+			done = true
+			break
+		}
+		if !DocGetOk(err) {
+			c.Errorf("t.Next failed: %v", err)
+			break
+		}
+		
+		for term := range spellTerms(&ent) {
+			getShard(spellShardOf(term))[term]++
+		}
+	}
+	
+	if done {
+		// all documents counted, merge the shards saved by previous runs and
+		// publish them all
+		buildKeys, err := datastore.NewQuery(kindSpellBuild).KeysOnly().GetAll(c, nil)
+		if err != nil {
+			// keep the cursor and retry next time
+			c.Errorf("Query %s failed: %v", kindSpellBuild, err)
+			return i
+		}
+		for _, key := range buildKeys {
+			if id := key.StringID(); !strings.Contains(id, "/") {
+				getShard(id)
+			}
+		}
+		
+		termsDB := NewCachedDocDB(c, kindSpellTerms)
+		// shard ID -> number of parts
+		published := make(map[string]int)
+		for id, m := range shards {
+			// too rare to be corrections, correctWord counts them as missing
+			for term, cnt := range m {
+				if cnt < minSpellHits {
+					delete(m, term)
+				}
+			}
+			parts, err := putSpellShard(termsDB, id, m)
+			if err != nil {
+				c.Errorf("Put(%s, %s) failed: %v", kindSpellTerms, id, err)
+				return i
+			}
+			published[id] = parts
+		}
+		// remove the shards and parts of the previous dictionary not in this one
+		termKeys, err := datastore.NewQuery(kindSpellTerms).KeysOnly().GetAll(c, nil)
+		if err != nil {
+			c.Errorf("Query %s failed: %v", kindSpellTerms, err)
+		}
+		for _, key := range termKeys {
+			id := key.StringID()
+			base, part := id, 0
+			if p := strings.Index(id, "/"); p >= 0 {
+				base = id[:p]
+				if part, err = strconv.Atoi(id[p+1:]); err != nil {
+					part = -1
+				}
+			}
+			if parts, ok := published[base]; ok && part >= 0 && part < parts {
+				continue
+			}
+			if err := termsDB.Delete(id); err != nil {
+				c.Errorf("Delete(%s, %s) failed: %v", kindSpellTerms, id, err)
+			}
+		}
+		
+		if err := datastore.DeleteMulti(c, buildKeys); err != nil {
+			c.Errorf("Clearing %s failed: %v", kindSpellBuild, err)
+		}
+		c.Infof("Spelling dictionary of %d shards built in %v", len(shards),
+			time.Now().Sub(state.Started))
+		state.Cursor = ""
+	} else {
+		for id := range shards {
+			if _, err := putSpellShard(buildDB, id, shards[id]); err != nil {
+				c.Errorf("Put(%s, %s) failed: %v", kindSpellBuild, id, err)
+				return i
+			}
+		}
+		cursor, err := t.Cursor()
+		if err != nil {
+			c.Errorf("t.Cursor failed: %v", err)
+			return i
+		}
+		state.Cursor = cursor.String()
+	}
+	
+	if err := stateDB.Put(spellStateID, &state); err != nil {
+		c.Errorf("Put(%s) failed: %v", kindSpellState, err)
+	}
+	return i
+}
+
+// editDistance returns the optimal string alignment distance of a and b, i.e.
+// the Levenshtein distance counting a transposition as one edit.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev2 := make([]int, len(rb)+1)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			d := prev[j-1] + cost
+			if prev[j]+1 < d {
+				d = prev[j] + 1
+			}
+			if cur[j-1]+1 < d {
+				d = cur[j-1] + 1
+			}
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] &&
+					prev2[j-2]+1 < d {
+				d = prev2[j-2] + 1
+			}
+			cur[j] = d
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(rb)]
+}
+
+func maxEdits(term string) int {
+	if len(term) <= 4 {
+		return 1
+	}
+	return 2
+}
+
+// spellShardsOf returns the shards of the candidates of a spellable term.
+func spellShardsOf(term string) []string {
+	var ids []string
+	for l := len(term) - maxEdits(term); l <= len(term)+maxEdits(term); l++ {
+		ids = append(ids, strconv.Itoa(l))
+	}
+	return ids
+}
+
+// the endings tried by spellSurface to restore the words of stemmed terms
+var spellEndings = []string{"", "e", "s", "es", "ed", "ing"}
+
+// spellSurface returns the word, of those stemmed to term, nearest to word.
+func spellSurface(word, term string) string {
+	best, bestDist := term, editDistance(word, term)
+	try := func(w string) {
+		if d := editDistance(word, w); d < bestDist && normWord(w) == term {
+			best, bestDist = w, d
+		}
+	}
+	for _, end := range spellEndings {
+		try(term + end)
+	}
+	if strings.HasSuffix(term, "i") {
+		// e.g. librari for library
+		try(term[:len(term)-1] + "y")
+	}
+	return best
+}
+
+// correctWord returns the correction of word, a lower-cased query word, by the
+// most frequent term of the least edit distance to its term in the shards of
+// the dictionary, or "" if the term is not rare or none is much more frequent.
+func correctWord(shards []map[string]int, word string) string {
+	term := normWord(word)
+	// terms rarer than minSpellHits are not in the dictionary
+	cnt := minSpellHits - 1
+	for _, sh := range shards {
+		if c, ok := sh[term]; ok {
+			cnt = c
+		}
+	}
+	if cnt >= minSpellHits {
+		return ""
+	}
+	
+	minCnt := cnt * minSpellGain
+	best, bestDist, bestCnt := "", maxEdits(term)+1, 0
+	for _, sh := range shards {
+		for t, tCnt := range sh {
+			if tCnt <= minCnt {
+				continue
+			}
+			if l := len(t) - len(term); l > maxEdits(term) || l < -maxEdits(term) {
+				continue
+			}
+			d := editDistance(term, t)
+			if d == 0 || d > maxEdits(term) {
+				continue
+			}
+			if d < bestDist || d == bestDist && tCnt > bestCnt {
+				best, bestDist, bestCnt = t, d, tCnt
+			}
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return spellSurface(word, best)
+}
+
+// loadSpellShard returns the live shard of the spelling dictionary.
+func loadSpellShard(c appengine.Context, id string) map[string]int {
+	m, err := getSpellShard(NewCachedDocDB(c, kindSpellTerms), id)
+	if err != nil {
+		c.Errorf("Get(%s, %s) failed: %v", kindSpellTerms, id, err)
+	}
+	return m
+}
+
+// suggestQuery returns q with rare words replaced by their corrections, or ""
+// if nothing is corrected.
+func suggestQuery(c appengine.Context, q string) string {
+	words := strings.Fields(q)
+	shards := make(map[string]map[string]int)
+	corrected := false
+	for i, word := range words {
+		lw := strings.ToLower(word)
+		if !spellable(lw) {
+			continue
+		}
+		term := normWord(lw)
+		if !spellable(term) {
+			continue
+		}
+		
+		var dict []map[string]int
+		for _, id := range spellShardsOf(term) {
+			sh, ok := shards[id]
+			if !ok {
+				sh = loadSpellShard(c, id)
+				shards[id] = sh
+			}
+			dict = append(dict, sh)
+		}
+		
+		if corr := correctWord(dict, lw); corr != "" {
+			words[i] = corr
+			corrected = true
+		}
+	}
+	
+	if !corrected {
+		return ""
+	}
+	return strings.Join(words, " ")
+}
+
+// resultsQuery returns the query of results of searchWithSuggestion for q.
+func resultsQuery(q string, results *SearchResult) string {
+	if results.Corrected {
+		return results.Suggestion
+	}
+	return q
+}
+
+// searchWithSuggestion searches q and suggests a corrected query if some words
+// of q are rare. If q has no results and autoCorrect is true, the corrected
+// query is searched instead.
+func searchWithSuggestion(c appengine.Context, q string, opts SearchOptions,
+		k int, autoCorrect bool) (*SearchResult, villa.StrSet, error) {
+	results, tokens, err := cachedSearch(c, q, opts, k)
+	if err != nil {
+		return nil, nil, err
+	}
+	if results.TotalResults >= itemsPerPage {
+		return results, tokens, nil
+	}
+	
+	suggestion := suggestQuery(c, q)
+	if suggestion == "" {
+		return results, tokens, nil
+	}
+	results.Suggestion = suggestion
+	
+	if results.TotalResults == 0 && autoCorrect {
+		corrResults, corrTokens, err := cachedSearch(c, suggestion, opts, k)
+		if err != nil {
+			return nil, nil, err
+		}
+		if corrResults.TotalResults > 0 {
+			c.Infof("Query %s corrected to %s", q, suggestion)
+			corrResults.Suggestion = suggestion
+			corrResults.Corrected = true
+			return corrResults, corrTokens, nil
+		}
+	}
+	
+	return results, tokens, nil
+}
@@ -0,0 +1,68 @@
+package gocode
+
+import (
+	"testing"
+)
+
+func TestCorrectWord(t *testing.T) {
+	// document frequencies of the index terms of the words
+	dict := make(map[string]int)
+	for word, cnt := range map[string]int{
+		"postgres":   120,
+		"postgresql": 40,
+		"websocket":  200,
+		"socket":     300,
+		"redis":      150,
+		"library":    500,
+		"json":       900,
+		"yaml":       80,
+		"web":        1000,
+	} {
+		dict[normWord(word)] = cnt
+	}
+	
+	for _, c := range []struct {
+		word, corr string
+	}{
+		{"postgress", "postgres"},
+		{"websoket", "websocket"},
+		// typos in the first letters
+		{"pstgres", "postgres"},
+		{"wbesocket", "websocket"},
+		{"reddis", "redis"},
+		{"libary", "library"},
+		{"jsn", "json"},
+		// frequent words are not corrected
+		{"websocket", ""},
+		{"postgres", ""},
+		// too far from any term
+		{"kubernetes", ""},
+	} {
+		if corr := correctWord([]map[string]int{dict}, c.word); corr != c.corr {
+			t.Errorf("correctWord(%q) = %q, want %q", c.word, corr, c.corr)
+		}
+	}
+}
+
+func TestSpellShardsOf(t *testing.T) {
+	// the shards of a term cover all terms within its maximum edit distance
+	for _, c := range []struct {
+		a, b string
+	}{
+		{"postgress", "postgr"},
+		{"websoket", "websocket"},
+		{"jsn", "json"},
+	} {
+		a, b := normWord(c.a), normWord(c.b)
+		found := false
+		for _, id := range spellShardsOf(a) {
+			if id == spellShardOf(b) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("shard %s of %q not in spellShardsOf(%q) = %v",
+				spellShardOf(b), b, a, spellShardsOf(a))
+		}
+	}
+}
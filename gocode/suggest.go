@@ -0,0 +1,593 @@
+package gocode
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/delay"
+	"appengine/memcache"
+	"github.com/daviddengcn/go-villa"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Completions of package names and import paths are stored in kindSuggest,
+// sharded by the lower-cased keys: their first suggestShardLen runes, or for
+// paths, the first element and the first suggestShardLen runes of the next one,
+// e.g. "github.com/da". Indexed and removed documents are queued in
+// kindSuggestUpdate and applied to the shards in batches by the /index cron.
+// Searches are counted in memcache and flushed by the /index cron to
+// kindQueryCount, which also keeps the most popular queries of each shard in
+// it. Each instance keeps the recently served shards as lists sorted by keys,
+// so a keystroke is answered from memory.
+const (
+	suggestShardLen = 2
+	// a shard keeps at most this number of entries with the highest scores
+	maxSuggestShardSize = 5000
+	// the maximum number of queued updates applied at a time
+	maxSuggestUpdates = 1000
+	
+	// the maximum number of completions returned by /suggest
+	maxSuggestions = 10
+	// the maximum number of popular queries among them
+	maxQuerySuggestions = 3
+	// the number of popular queries kept in a shard
+	maxSuggestQueries = 200
+	// the maximum number of queued query counts flushed at a time
+	maxQueryCountFlushes = 1000
+	
+	// the maximum number of shards cached in an instance
+	maxCachedSuggestShards = 100
+	// cached shards are reloaded after this interval
+	suggestReloadInterval = 10 * time.Minute
+)
+
+// SuggestShard holds the completions of a shard in parallel slices. Texts are
+// the names or import paths shown, Keys are what is matched with the prefix.
+type SuggestShard struct {
+	Keys     []string  `datastore:",noindex"`
+	Texts    []string  `datastore:",noindex"`
+	Packages []string  `datastore:",noindex"`
+	Scores   []float64 `datastore:",noindex"`
+	// the most popular queries in the shard, in descending order of counts
+	Queries     []string `datastore:",noindex"`
+	QueryCounts []int    `datastore:",noindex"`
+}
+
+// SuggestUpdate is a queued update of the completions of a package.
+type SuggestUpdate struct {
+	Name  string  `datastore:",noindex"`
+	Score float64 `datastore:",noindex"`
+	// true if the package is removed
+	Removed bool `datastore:",noindex"`
+}
+
+// QueryCount is the number of searches of a normalized query with results.
+type QueryCount struct {
+	Query string
+	Count int
+	Last  time.Time `datastore:",noindex"`
+}
+
+// Suggestion is a completion returned by /suggest. Package is empty for a
+// popular query.
+type Suggestion struct {
+	Text    string
+	Package string `json:",omitempty"`
+}
+
+// SuggestResponse is the response of /suggest.
+type SuggestResponse struct {
+	Query       string
+	Suggestions []Suggestion
+}
+
+// suggestShardOf returns the shard of a key, or of a prefix if shardable
+// returns true for it.
+func suggestShardOf(key string) string {
+	head, rest := splitSuggestKey(key)
+	return head + runePrefix(rest, suggestShardLen)
+}
+
+// shardable returns true if prefix is long enough to tell its shard.
+func shardable(prefix string) bool {
+	_, rest := splitSuggestKey(prefix)
+	return utf8.RuneCountInString(rest) >= suggestShardLen
+}
+
+// splitSuggestKey splits key after the first slash, if any.
+func splitSuggestKey(key string) (head, rest string) {
+	if p := strings.Index(key, "/"); p >= 0 {
+		return key[:p+1], key[p+1:]
+	}
+	return "", key
+}
+
+// runePrefix returns the first n runes of s.
+func runePrefix(s string, n int) string {
+	for p := range s {
+		if n == 0 {
+			return s[:p]
+		}
+		n--
+	}
+	return s
+}
+
+// normQuery returns the lower-cased query with spaces collapsed.
+func normQuery(q string) string {
+	return strings.ToLower(strings.Join(strings.Fields(q), " "))
+}
+
+// suggestKeys returns the texts of pkg's completions by their keys: the name,
+// the import path and the path without the host.
+func suggestKeys(name, pkg string) map[string]string {
+	keys := make(map[string]string)
+	if name != "" {
+		keys[strings.ToLower(name)] = name
+	}
+	keys[strings.ToLower(pkg)] = pkg
+	if p := strings.Index(pkg, "/"); p > 0 && p+1 < len(pkg) {
+		keys[strings.ToLower(pkg[p+1:])] = pkg
+	}
+	return keys
+}
+
+func (sh *SuggestShard) Len() int {
+	return len(sh.Keys)
+}
+
+func (sh *SuggestShard) Less(i, j int) bool {
+	return sh.Scores[i] > sh.Scores[j]
+}
+
+func (sh *SuggestShard) Swap(i, j int) {
+	sh.Keys[i], sh.Keys[j] = sh.Keys[j], sh.Keys[i]
+	sh.Texts[i], sh.Texts[j] = sh.Texts[j], sh.Texts[i]
+	sh.Packages[i], sh.Packages[j] = sh.Packages[j], sh.Packages[i]
+	sh.Scores[i], sh.Scores[j] = sh.Scores[j], sh.Scores[i]
+}
+
+// remove deletes the entries of pkg.
+func (sh *SuggestShard) remove(pkg string) {
+	n := 0
+	for i := range sh.Keys {
+		if sh.Packages[i] == pkg {
+			continue
+		}
+		sh.Keys[n], sh.Texts[n] = sh.Keys[i], sh.Texts[i]
+		sh.Packages[n], sh.Scores[n] = sh.Packages[i], sh.Scores[i]
+		n++
+	}
+	sh.Keys, sh.Texts = sh.Keys[:n], sh.Texts[:n]
+	sh.Packages, sh.Scores = sh.Packages[:n], sh.Scores[:n]
+}
+
+func (sh *SuggestShard) add(key, text, pkg string, score float64) {
+	sh.Keys = append(sh.Keys, key)
+	sh.Texts = append(sh.Texts, text)
+	sh.Packages = append(sh.Packages, pkg)
+	sh.Scores = append(sh.Scores, score)
+}
+
+// pkgSuggestions are the completions of a package to replace its entries in
+// shards. keys are nil if the package is removed.
+type pkgSuggestions struct {
+	pkg   string
+	keys  map[string]string
+	score float64
+}
+
+// updateSuggestShard replaces the entries of packages in shard id by theirs.
+func updateSuggestShard(c appengine.Context, id string, ups []pkgSuggestions) error {
+	key := datastore.NewKey(c, kindSuggest, id, 0, nil)
+	err := datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		var sh SuggestShard
+		if err := datastore.Get(tc, key, &sh); err != datastore.ErrNoSuchEntity && !DocGetOk(err) {
+			return err
+		}
+		
+		for _, up := range ups {
+			sh.remove(up.pkg)
+			for k, text := range up.keys {
+				if suggestShardOf(k) == id {
+					sh.add(k, text, up.pkg, up.score)
+				}
+			}
+		}
+		sort.Sort(&sh)
+		if sh.Len() > maxSuggestShardSize {
+			sh.Keys, sh.Texts = sh.Keys[:maxSuggestShardSize], sh.Texts[:maxSuggestShardSize]
+			sh.Packages = sh.Packages[:maxSuggestShardSize]
+			sh.Scores = sh.Scores[:maxSuggestShardSize]
+		}
+		
+		_, err := datastore.Put(tc, key, &sh)
+		return err
+	}, nil)
+	if err != nil {
+		return err
+	}
+	
+	NewCachedDocDB(c, kindSuggest).Invalidate(id)
+	return nil
+}
+
+// indexSuggestions queues the update of the completions of an indexed
+// document.
+func indexSuggestions(c appengine.Context, doc *DocInfo) {
+	err := NewDocDB(c, kindSuggestUpdate).Put(doc.Package, &SuggestUpdate{
+		Name:  doc.Name,
+		Score: doc.StaticScore,
+	})
+	if err != nil {
+		c.Errorf("Put(%s, %s) failed: %v", kindSuggestUpdate, doc.Package, err)
+	}
+}
+
+// removeSuggestions queues the removal of the completions of a package named
+// name.
+func removeSuggestions(c appengine.Context, name, pkg string) {
+	err := NewDocDB(c, kindSuggestUpdate).Put(pkg, &SuggestUpdate{
+		Name:    name,
+		Removed: true,
+	})
+	if err != nil {
+		c.Errorf("Put(%s, %s) failed: %v", kindSuggestUpdate, pkg, err)
+	}
+}
+
+// applySuggestUpdates applies at most maxSuggestUpdates queued updates, with
+// one transaction a shard. Returns the number of updates applied.
+func applySuggestUpdates(c appengine.Context) int {
+	var ups []SuggestUpdate
+	keys, err := datastore.NewQuery(kindSuggestUpdate).Limit(maxSuggestUpdates).
+		GetAll(c, &ups)
+	if err != nil && !DocGetOk(err) {
+		c.Errorf("Query %s failed: %v", kindSuggestUpdate, err)
+		return 0
+	}
+	
+	shards := make(map[string][]pkgSuggestions)
+	for i, key := range keys {
+		pkg := key.StringID()
+		sugKeys := suggestKeys(ups[i].Name, pkg)
+		ps := pkgSuggestions{pkg: pkg, keys: sugKeys, score: ups[i].Score}
+		if ups[i].Removed {
+			ps.keys = nil
+		}
+		added := make(map[string]bool)
+		for k := range sugKeys {
+			if id := suggestShardOf(k); !added[id] {
+				added[id] = true
+				shards[id] = append(shards[id], ps)
+			}
+		}
+	}
+	
+	for id, ps := range shards {
+		if err := updateSuggestShard(c, id, ps); err != nil {
+			// the updates are kept and applied again next time
+			c.Errorf("Update %d suggestions in %s failed: %v", len(ps), id, err)
+			return 0
+		}
+	}
+	if err := datastore.DeleteMulti(c, keys); err != nil {
+		c.Errorf("Delete %d of %s failed: %v", len(keys), kindSuggestUpdate, err)
+	}
+	return len(keys)
+}
+
+// countQuery increases the search count of q in memcache. A query counted for
+// the first time since the last flush is queued in kindQueryToCount.
+func countQuery(c appengine.Context, q string) {
+	q = normQuery(q)
+	if q == "" || len(q) > 100 {
+		return
+	}
+	
+	n, err := memcache.Increment(c, prefixQueryCount+q, 1, 0)
+	if err != nil {
+		c.Errorf("Increment count of %q failed: %v", q, err)
+		return
+	}
+	if n == 1 {
+		queueQueryCount.Call(c, q)
+	}
+}
+
+var queueQueryCount = delay.Func("queueQueryCount", func(c appengine.Context,
+		q string) error {
+	return NewDocDB(c, kindQueryToCount).Put(q, &struct{}{})
+})
+
+// addQueryCount adds n to the count of q and returns the total.
+func addQueryCount(c appengine.Context, q string, n int) (*QueryCount, error) {
+	key := datastore.NewKey(c, kindQueryCount, q, 0, nil)
+	var qc QueryCount
+	err := datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		qc = QueryCount{}
+		if err := datastore.Get(tc, key, &qc); err != datastore.ErrNoSuchEntity && !DocGetOk(err) {
+			return err
+		}
+		qc.Query = q
+		qc.Count += n
+		qc.Last = time.Now()
+		_, err := datastore.Put(tc, key, &qc)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &qc, nil
+}
+
+// flushQueryCounts moves at most maxQueryCountFlushes queued counts from
+// memcache to kindQueryCount, and updates the popular queries of their shards.
+// Returns the number of queries flushed.
+func flushQueryCounts(c appengine.Context) int {
+	keys, err := datastore.NewQuery(kindQueryToCount).KeysOnly().
+		Limit(maxQueryCountFlushes).GetAll(c, nil)
+	if err != nil {
+		c.Errorf("Query %s failed: %v", kindQueryToCount, err)
+		return 0
+	}
+	
+	shards := make(map[string][]QueryCount)
+	var done []*datastore.Key
+	for _, key := range keys {
+		q := key.StringID()
+		mcKey := prefixQueryCount + q
+		n, err := memcache.Increment(c, mcKey, 0, 0)
+		if err != nil {
+			c.Errorf("Increment count of %q failed: %v", q, err)
+			continue
+		}
+		if n > 0 {
+			qc, err := addQueryCount(c, q, int(n))
+			if err != nil {
+				c.Errorf("Count query %q failed: %v", q, err)
+				continue
+			}
+			id := suggestShardOf(q)
+			shards[id] = append(shards[id], *qc)
+			
+			// counts since the read are kept
+			if n, err = memcache.Increment(c, mcKey, -int64(n), 0); err != nil {
+				c.Errorf("Decrement count of %q failed: %v", q, err)
+				continue
+			}
+		}
+		if n == 0 {
+			done = append(done, key)
+		}
+	}
+	
+	for id, qcs := range shards {
+		if err := updateShardQueries(c, id, qcs); err != nil {
+			c.Errorf("Update %d queries in %s failed: %v", len(qcs), id, err)
+		}
+	}
+	if err := datastore.DeleteMulti(c, done); err != nil {
+		c.Errorf("Delete %d of %s failed: %v", len(done), kindQueryToCount, err)
+	}
+	return len(keys)
+}
+
+// updateShardQueries merges the counts of queries into the popular queries of
+// shard id.
+func updateShardQueries(c appengine.Context, id string, qcs []QueryCount) error {
+	key := datastore.NewKey(c, kindSuggest, id, 0, nil)
+	err := datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		var sh SuggestShard
+		if err := datastore.Get(tc, key, &sh); err != datastore.ErrNoSuchEntity && !DocGetOk(err) {
+			return err
+		}
+		
+		counts := make(map[string]int)
+		for i, q := range sh.Queries {
+			counts[q] = sh.QueryCounts[i]
+		}
+		for _, qc := range qcs {
+			counts[qc.Query] = qc.Count
+		}
+		qs := make([]string, 0, len(counts))
+		for q := range counts {
+			qs = append(qs, q)
+		}
+		villa.SortF(len(qs), func(i, j int) bool {
+			if counts[qs[i]] != counts[qs[j]] {
+				return counts[qs[i]] > counts[qs[j]]
+			}
+			return qs[i] < qs[j]
+		}, func(i, j int) {
+			qs[i], qs[j] = qs[j], qs[i]
+		})
+		if len(qs) > maxSuggestQueries {
+			qs = qs[:maxSuggestQueries]
+		}
+		sh.Queries, sh.QueryCounts = qs, make([]int, len(qs))
+		for i, q := range qs {
+			sh.QueryCounts[i] = counts[q]
+		}
+		
+		_, err := datastore.Put(tc, key, &sh)
+		return err
+	}, nil)
+	if err != nil {
+		return err
+	}
+	
+	NewCachedDocDB(c, kindSuggest).Invalidate(id)
+	return nil
+}
+
+// suggestEntry is a completion in a suggestList. rank is its position in
+// descending order of scores.
+type suggestEntry struct {
+	key, text, pkg string
+	rank           int
+}
+
+// suggestList is sorted by keys, then ranks.
+type suggestList []suggestEntry
+
+// newSuggestList returns the list of the entries given in descending order of
+// scores.
+func newSuggestList(keys, texts, pkgs []string) suggestList {
+	l := make(suggestList, len(keys))
+	for i := range keys {
+		l[i] = suggestEntry{key: keys[i], text: texts[i], rank: i}
+		if pkgs != nil {
+			l[i].pkg = pkgs[i]
+		}
+	}
+	sort.Sort(l)
+	return l
+}
+
+func (l suggestList) Len() int { return len(l) }
+
+func (l suggestList) Less(i, j int) bool {
+	if l[i].key != l[j].key {
+		return l[i].key < l[j].key
+	}
+	return l[i].rank < l[j].rank
+}
+
+func (l suggestList) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+
+// complete returns at most n best entries with keys of prefix, in ascending
+// order of ranks.
+func (l suggestList) complete(prefix string, n int) []suggestEntry {
+	var top []suggestEntry
+	start := sort.Search(len(l), func(i int) bool { return l[i].key >= prefix })
+	for i := start; i < len(l) && strings.HasPrefix(l[i].key, prefix); i++ {
+		e := l[i]
+		if len(top) == n && e.rank >= top[n-1].rank {
+			continue
+		}
+		p := sort.Search(len(top), func(j int) bool { return top[j].rank > e.rank })
+		if len(top) < n {
+			top = append(top, suggestEntry{})
+		}
+		copy(top[p+1:], top[p:])
+		top[p] = e
+	}
+	return top
+}
+
+// suggestLists are the cached lists of a shard.
+type suggestLists struct {
+	packages suggestList
+	queries  suggestList
+	loadTime time.Time
+	// guarded by suggestCache
+	useTime time.Time
+}
+
+var suggestCache struct {
+	sync.Mutex
+	shards map[string]*suggestLists
+}
+
+func loadSuggestLists(c appengine.Context, id string) *suggestLists {
+	var sh SuggestShard
+	if err, _ := NewCachedDocDB(c, kindSuggest).Get(id, &sh); err != nil {
+		c.Errorf("Get(%s, %s) failed: %v", kindSuggest, id, err)
+	}
+	// shards are saved sorted by scores and counts
+	return &suggestLists{
+		packages: newSuggestList(sh.Keys, sh.Texts, sh.Packages),
+		queries:  newSuggestList(sh.Queries, sh.Queries, nil),
+		loadTime: time.Now(),
+	}
+}
+
+// shardLists returns the lists of shard id, loading them if expired. The least
+// recently used shard is evicted when more than maxCachedSuggestShards are
+// cached.
+func shardLists(c appengine.Context, id string) *suggestLists {
+	suggestCache.Lock()
+	ls := suggestCache.shards[id]
+	if ls != nil {
+		ls.useTime = time.Now()
+	}
+	suggestCache.Unlock()
+	
+	if ls != nil && time.Now().Sub(ls.loadTime) < suggestReloadInterval {
+		return ls
+	}
+	
+	ls = loadSuggestLists(c, id)
+	suggestCache.Lock()
+	defer suggestCache.Unlock()
+	if suggestCache.shards == nil {
+		suggestCache.shards = make(map[string]*suggestLists)
+	}
+	ls.useTime = time.Now()
+	suggestCache.shards[id] = ls
+	if len(suggestCache.shards) > maxCachedSuggestShards {
+		var lru string
+		for sid, sls := range suggestCache.shards {
+			if lru == "" || sls.useTime.Before(suggestCache.shards[lru].useTime) {
+				lru = sid
+			}
+		}
+		delete(suggestCache.shards, lru)
+	}
+	return ls
+}
+
+// suggest returns at most maxSuggestions completions of q: popular queries
+// first, then packages by their static scores.
+func suggest(c appengine.Context, q string) []Suggestion {
+	prefix := normQuery(q)
+	sugs := []Suggestion{}
+	if !shardable(prefix) {
+		return sugs
+	}
+	
+	ls := shardLists(c, suggestShardOf(prefix))
+	// the query equal to prefix is skipped
+	for _, e := range ls.queries.complete(prefix, maxQuerySuggestions+1) {
+		if len(sugs) == maxQuerySuggestions {
+			break
+		}
+		if e.text != prefix {
+			sugs = append(sugs, Suggestion{Text: e.text})
+		}
+	}
+	
+	// packages may have several keys with prefix
+	seen := make(map[string]bool)
+	for _, e := range ls.packages.complete(prefix, 2*maxSuggestions) {
+		if len(sugs) == maxSuggestions {
+			break
+		}
+		if seen[e.pkg] {
+			continue
+		}
+		seen[e.pkg] = true
+		sugs = append(sugs, Suggestion{
+			Text:    e.text,
+			Package: e.pkg,
+		})
+	}
+	return sugs
+}
+
+// pageSuggest returns the completions of q as JSON.
+func pageSuggest(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	q := r.FormValue("q")
+	
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, SuggestResponse{
+		Query:       q,
+		Suggestions: suggest(c, q),
+	})
+}
@@ -0,0 +1,42 @@
+package gocode
+
+import (
+	"testing"
+)
+
+func TestSuggestListComplete(t *testing.T) {
+	// in descending order of scores
+	l := newSuggestList(
+		[]string{"gorilla/mux", "go", "gorm", "golang", "gorilla", "gob"},
+		[]string{"mux", "go", "gorm", "golang", "gorilla", "gob"}, nil)
+	for _, c := range []struct {
+		prefix string
+		n      int
+		texts  []string
+	}{
+		{"gor", 10, []string{"mux", "gorm", "gorilla"}},
+		{"gor", 2, []string{"mux", "gorm"}},
+		{"go", 3, []string{"mux", "go", "gorm"}},
+		{"gob", 10, []string{"gob"}},
+		{"gox", 10, nil},
+		{"z", 10, nil},
+	} {
+		top := l.complete(c.prefix, c.n)
+		var texts []string
+		for _, e := range top {
+			texts = append(texts, e.text)
+		}
+		if len(texts) != len(c.texts) {
+			t.Errorf("complete(%q, %d) = %v, want %v", c.prefix, c.n, texts,
+				c.texts)
+			continue
+		}
+		for i := range texts {
+			if texts[i] != c.texts[i] {
+				t.Errorf("complete(%q, %d) = %v, want %v", c.prefix, c.n,
+					texts, c.texts)
+				break
+			}
+		}
+	}
+}
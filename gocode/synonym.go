@@ -0,0 +1,182 @@
+package gocode
+
+import (
+	"appengine"
+	"bufio"
+	"github.com/daviddengcn/go-villa"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The synonym dictionary is read from synonymsFile and the admin edited entity
+// in kindSynonym. Each line is a group of equivalent phrases separated by
+// commas, e.g.
+//
+//     db, database
+//     orm, object relational mapping
+//
+// Lines starting with '#' are comments. A phrase analyzed into a single term
+// is expanded into the other phrases of its group at query time.
+const (
+	synonymsFile = "synonyms.txt"
+	synonymsID   = "dict"
+	
+	// the dictionary is reloaded after this interval
+	synonymsReloadInterval = time.Minute
+	// the weight of a match by a synonym relative to the exact term
+	SynonymWeight = 0.5
+	// the maximum number of index queries of an expanded query
+	maxSynonymQueries = 16
+)
+
+// SynonymsEntity is the admin edited part of the synonym dictionary.
+type SynonymsEntity struct {
+	Text string `datastore:",noindex"`
+}
+
+// QueryGroup is a term of the query with its synonyms, each of which is a set
+// of terms.
+type QueryGroup struct {
+	Token    string
+	Synonyms []villa.StrSet
+}
+
+var synonymDict struct {
+	sync.Mutex
+	dict     map[string][]villa.StrSet
+	loadTime time.Time
+}
+
+// parseSynonyms parses lines of synonym groups and adds them to dict.
+func parseSynonyms(dict map[string][]villa.StrSet, text string) {
+	s := bufio.NewScanner(strings.NewReader(text))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		
+		var phrases []villa.StrSet
+		for _, phrase := range strings.Split(line, ",") {
+			if terms := analyzeTokens(queryAnalyzer, nil, phrase); len(terms) > 0 {
+				phrases = append(phrases, terms)
+			}
+		}
+		
+		for i, terms := range phrases {
+			if len(terms) != 1 {
+				continue
+			}
+			key := terms.Elements()[0]
+			for j, syn := range phrases {
+				if j != i && !(len(syn) == 1 && syn.In(key)) {
+					dict[key] = append(dict[key], syn)
+				}
+			}
+		}
+	}
+}
+
+func readSynonymsFile(c appengine.Context) string {
+	text, err := ioutil.ReadFile(synonymsFile)
+	if err != nil {
+		c.Errorf("Read %s failed: %v", synonymsFile, err)
+	}
+	return string(text)
+}
+
+// loadSynonymsEntity returns the admin edited synonyms, "" if not set.
+func loadSynonymsEntity(c appengine.Context) string {
+	var ent SynonymsEntity
+	if err, _ := NewDocDB(c, kindSynonym).Get(synonymsID, &ent); err != nil {
+		c.Errorf("Get(%s, %s) failed: %v", kindSynonym, synonymsID, err)
+	}
+	return ent.Text
+}
+
+func saveSynonymsEntity(c appengine.Context, text string) error {
+	err := NewDocDB(c, kindSynonym).Put(synonymsID, &SynonymsEntity{Text: text})
+	if err != nil {
+		return err
+	}
+	
+	// reload on this instance now, others reload in synonymsReloadInterval
+	synonymDict.Lock()
+	synonymDict.loadTime = time.Time{}
+	synonymDict.Unlock()
+	// results of expanded queries change
+	bumpIndexGeneration(c)
+	return nil
+}
+
+// synonyms returns the current dictionary, reloading it if expired.
+func synonyms(c appengine.Context) map[string][]villa.StrSet {
+	synonymDict.Lock()
+	defer synonymDict.Unlock()
+	
+	if synonymDict.dict != nil &&
+			time.Now().Sub(synonymDict.loadTime) < synonymsReloadInterval {
+		return synonymDict.dict
+	}
+	
+	dict := make(map[string][]villa.StrSet)
+	parseSynonyms(dict, readSynonymsFile(c))
+	parseSynonyms(dict, loadSynonymsEntity(c))
+	c.Infof("%d synonym entries loaded", len(dict))
+	
+	synonymDict.dict, synonymDict.loadTime = dict, time.Now()
+	return dict
+}
+
+// expandQuery returns the groups of the query terms with their synonyms.
+func expandQuery(c appengine.Context, tokens villa.StrSet) []QueryGroup {
+	dict := synonyms(c)
+	
+	groups := make([]QueryGroup, 0, len(tokens))
+	for _, token := range tokens.Elements() {
+		groups = append(groups, QueryGroup{
+			Token:    token,
+			Synonyms: dict[token],
+		})
+	}
+	return groups
+}
+
+// groupsTokens returns all the terms in groups, including synonyms.
+func groupsTokens(groups []QueryGroup) villa.StrSet {
+	var tokens villa.StrSet
+	for _, g := range groups {
+		tokens.Put(g.Token)
+		for _, syn := range g.Synonyms {
+			tokens.Put(syn.Elements()...)
+		}
+	}
+	return tokens
+}
+
+// groupsQueries returns the token sets of the index queries of groups. The
+// union of their results matches every group by its term or a synonym.
+// Synonyms of later groups are ignored if there are too many combinations.
+func groupsQueries(groups []QueryGroup) []villa.StrSet {
+	queries := []villa.StrSet{nil}
+	for _, g := range groups {
+		alts := []villa.StrSet{villa.NewStrSet(g.Token)}
+		if len(queries)*(1+len(g.Synonyms)) <= maxSynonymQueries {
+			alts = append(alts, g.Synonyms...)
+		}
+		
+		var next []villa.StrSet
+		for _, q := range queries {
+			for _, alt := range alts {
+				var tokens villa.StrSet
+				tokens.Put(q.Elements()...)
+				tokens.Put(alt.Elements()...)
+				next = append(next, tokens)
+			}
+		}
+		queries = next
+	}
+	return queries
+}
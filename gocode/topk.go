@@ -0,0 +1,465 @@
+package gocode
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"github.com/daviddengcn/go-villa"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Matched documents are read as DocRows, the summaries in their index
+// entries, in pages in descending order of StaticScore. Filters, facets, fork
+// collapsing and sub-package folding work on the rows read. Only the DocInfos
+// needed to rank the top entries are fetched: the rank model bounds the score
+// of an entry by its row, e.g. for the default model
+//
+//     Score = (StaticScore - 0.9) * MatchScore <= (StaticScore - 0.9) * maxMatchScore
+//
+// and the evaluation stops once no remaining entry can beat the k-th best one.
+// Rows are read until no unread row can beat it either, bounded by the
+// StaticScore of the last row read, or until maxSearchRows are read.
+const (
+	// the number of DocInfos fetched at a time when ranking
+	rankFetchBatch = 2 * itemsPerPage
+	
+	// the number of rows read from a query at a time
+	searchPageRows = 200
+	// the maximum number of rows read by a search
+	maxSearchRows = 2000
+	
+	// the maxima of index entries are reloaded after this interval
+	indexMaximaReloadInterval = 10 * time.Minute
+)
+
+// DocRow is a matched document as summarized in its index entry.
+type DocRow struct {
+	Package string
+	IndexEntry
+}
+
+// SearchHit is an entry of search results: a package with the sub-packages
+// folded into it and its forks.
+type SearchHit struct {
+	Doc   *DocInfo
+	Subs  []*DocRow
+	Forks []*DocRow
+	// set on ?explain=1
+	Explain *Explanation
+}
+
+// hitEntry is an entry of search results before its DocInfo is fetched.
+type hitEntry struct {
+	row   *DocRow
+	subs  []*DocRow
+	forks []*DocRow
+}
+
+// indexEntryOf returns the index entry, with the tokens and the summary, of doc.
+func indexEntryOf(doc *DocInfo) *IndexEntry {
+	var tokens villa.StrSet
+	tokens = analyzeTokens(nameAnalyzer, tokens, doc.Name)
+	tokens = analyzeTokens(packageAnalyzer, tokens, doc.Package)
+	tokens = analyzeTokens(textAnalyzer, tokens, doc.Description)
+	tokens = analyzeTokens(readmeAnalyzer, tokens, doc.ReadmeData)
+	tokens = analyzeTokens(nameAnalyzer, tokens, doc.Author)
+
+	ent := indexSummaryOf(doc)
+	ent.Tokens = tokens.Elements()
+	return ent
+}
+
+// indexSummaryOf returns the index entry of doc without the tokens.
+func indexSummaryOf(doc *DocInfo) *IndexEntry {
+	return &IndexEntry{
+		StaticScore:   doc.StaticScore,
+		Name:          doc.Name,
+		StarCount:     doc.StarCount,
+		ImportedCount: len(doc.ImportedPkgs),
+		LastUpdated:   doc.LastUpdated,
+		License:       doc.License,
+		ForkOf:        doc.ForkOf,
+		Fingerprint:   docFingerprint(doc),
+		LastCommit:    doc.LastCommit,
+		Archived:      doc.Archived,
+		Deprecated:    doc.Deprecated,
+	}
+}
+
+// rowBefore returns true if row a is read before row b.
+func rowBefore(a, b *DocRow) bool {
+	if a.StaticScore != b.StaticScore {
+		return a.StaticScore > b.StaticScore
+	}
+	return a.Package < b.Package
+}
+
+// rowReader reads the rows of the documents matching any of the queries of
+// groups in descending order of StaticScore, merging the pages of the queries.
+type rowReader struct {
+	c      appengine.Context
+	pagers []*EntryPager
+	// rows read from the pagers but not returned
+	bufs [][]*DocRow
+	seen villa.StrSet
+	// the StaticScore of the last row returned, no unread row has a higher one
+	last    float64
+	started bool
+}
+
+func newRowReader(c appengine.Context, groups []QueryGroup) *rowReader {
+	ts := NewTokenSet(c, prefixIndex)
+	r := &rowReader{c: c}
+	for _, qTokens := range groupsQueries(groups) {
+		r.pagers = append(r.pagers, ts.PageEntries(fieldIndex, qTokens))
+	}
+	r.bufs = make([][]*DocRow, len(r.pagers))
+	return r
+}
+
+// fill reads the next page of pager i if its buffer is empty.
+func (r *rowReader) fill(i int) error {
+	if len(r.bufs[i]) > 0 || r.pagers[i].Done() {
+		return nil
+	}
+	ids, ents, err := r.pagers[i].Next(searchPageRows)
+	if err != nil {
+		return err
+	}
+	rows := make([]*DocRow, len(ids))
+	for j, id := range ids {
+		rows[j] = &DocRow{Package: id, IndexEntry: ents[j]}
+	}
+	if fillRowSummaries(r.c, rows) {
+		villa.SortF(len(rows), func(i, j int) bool {
+			return rowBefore(rows[i], rows[j])
+		}, func(i, j int) {
+			rows[i], rows[j] = rows[j], rows[i]
+		})
+	}
+	r.bufs[i] = rows
+	return nil
+}
+
+// next returns at most n more rows.
+func (r *rowReader) next(n int) ([]*DocRow, error) {
+	var rows []*DocRow
+	for len(rows) < n {
+		best := -1
+		for i := range r.pagers {
+			if err := r.fill(i); err != nil {
+				return nil, err
+			}
+			if len(r.bufs[i]) > 0 && (best < 0 ||
+					rowBefore(r.bufs[i][0], r.bufs[best][0])) {
+				best = i
+			}
+		}
+		if best < 0 {
+			break
+		}
+		
+		row := r.bufs[best][0]
+		r.bufs[best] = r.bufs[best][1:]
+		r.last, r.started = row.StaticScore, true
+		if r.seen.In(row.Package) {
+			continue
+		}
+		r.seen.Put(row.Package)
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// done returns true if all rows were read.
+func (r *rowReader) done() bool {
+	for i, p := range r.pagers {
+		if len(r.bufs[i]) > 0 || !p.Done() {
+			return false
+		}
+	}
+	return true
+}
+
+// tailBound returns the upper bound of the scores by m of the unread rows for
+// n query groups.
+func (r *rowReader) tailBound(m *RankModel, n int) float64 {
+	if r.done() {
+		return math.Inf(-1)
+	}
+	if !r.started {
+		return math.Inf(1)
+	}
+	
+	// the features of stars and importers are bounded by the maxima, and
+	// by 0 for negative weights
+	stars, importers := 0, 0
+	if m.Weights[featStars] > 0 || m.Weights[featImporters] > 0 {
+		maxStars, maxImporters := indexMaxima(r.c)
+		if m.Weights[featStars] > 0 {
+			stars = maxStars
+		}
+		if m.Weights[featImporters] > 0 {
+			importers = maxImporters
+		}
+	}
+	// static scores are not negative, and bounds are linear in them
+	return math.Max(m.boundOf(r.last, stars, importers, n),
+		m.boundOf(0, stars, importers, n))
+}
+
+var indexMaximaCache struct {
+	sync.Mutex
+	stars, importers int
+	loadTime         time.Time
+}
+
+// indexMaxima returns the maximum StarCount and ImportedCount of the index
+// entries. They may miss documents indexed by other instances after they
+// were loaded.
+func indexMaxima(c appengine.Context) (stars, importers int) {
+	indexMaximaCache.Lock()
+	defer indexMaximaCache.Unlock()
+	
+	if time.Now().Sub(indexMaximaCache.loadTime) < indexMaximaReloadInterval {
+		return indexMaximaCache.stars, indexMaximaCache.importers
+	}
+	
+	maxOf := func(field string) *IndexEntry {
+		var ents []IndexEntry
+		_, err := datastore.NewQuery(kindIndex).Project(field).
+			Order("-"+field).Limit(1).GetAll(c, &ents)
+		if err != nil && !DocGetOk(err) {
+			c.Errorf("Query maximum %s of %s failed: %v", field, kindIndex, err)
+			// unbounded
+			return &IndexEntry{StarCount: math.MaxInt32, ImportedCount: math.MaxInt32}
+		}
+		if len(ents) == 0 {
+			return &IndexEntry{}
+		}
+		return &ents[0]
+	}
+	stars, importers = maxOf("StarCount").StarCount,
+		maxOf("ImportedCount").ImportedCount
+	indexMaximaCache.stars, indexMaximaCache.importers = stars, importers
+	indexMaximaCache.loadTime = time.Now()
+	return stars, importers
+}
+
+// raiseIndexMaxima raises the cached maxima by an indexed entry.
+func raiseIndexMaxima(ent *IndexEntry) {
+	indexMaximaCache.Lock()
+	defer indexMaximaCache.Unlock()
+	
+	if ent.StarCount > indexMaximaCache.stars {
+		indexMaximaCache.stars = ent.StarCount
+	}
+	if ent.ImportedCount > indexMaximaCache.importers {
+		indexMaximaCache.importers = ent.ImportedCount
+	}
+}
+
+// fillRowSummaries fills the summaries of rows whose index entries were
+// written without them, from their DocInfos. Returns true if any is filled.
+func fillRowSummaries(c appengine.Context, rows []*DocRow) bool {
+	var missing []*DocRow
+	var ids []string
+	for _, row := range rows {
+		if row.Name == "" {
+			missing = append(missing, row)
+			ids = append(ids, row.Package)
+		}
+	}
+	if len(missing) == 0 {
+		return false
+	}
+
+	docs := make([]DocInfo, len(ids))
+	fetchDocs(c, ids, docs)
+	qw := qualityWeights(c)
+	for i, row := range missing {
+		if docs[i].Package != "" {
+			if docs[i].StaticScore < 1 {
+				// never scored
+				docs[i].updateStaticScore(qw)
+			}
+			row.IndexEntry = *indexSummaryOf(&docs[i])
+		}
+	}
+	return true
+}
+
+// closestAncestor returns the closest ancestor path of pkg, below the host and
+// the first element, for which in returns true, "" if none.
+func closestAncestor(pkg string, in func(string) bool) string {
+	parts := strings.Split(pkg, "/")
+	for i := len(parts) - 1; i >= 2; i-- {
+		root := strings.Join(parts[:i], "/")
+		if in(root) {
+			return root
+		}
+	}
+	return ""
+}
+
+// groupRows collapses forks and folds sub-packages into the closest ancestor
+// package in rows, returning the entries in the order of rows.
+func groupRows(rows []*DocRow, excludeForks bool) (entries []*hitEntry,
+		folded, forks int) {
+	groups := collapseForks(rows)
+
+	byPkg := make(map[string]*hitEntry, len(groups))
+	for _, g := range groups {
+		e := &hitEntry{row: g.Canonical}
+		if !excludeForks {
+			e.forks = g.Forks
+			forks += len(g.Forks)
+		}
+		entries = append(entries, e)
+		byPkg[e.row.Package] = e
+	}
+
+	// ancestors sort before their descendants
+	pkgs := make([]string, 0, len(byPkg))
+	for pkg := range byPkg {
+		pkgs = append(pkgs, pkg)
+	}
+	villa.SortF(len(pkgs), func(i, j int) bool {
+		return pkgs[i] < pkgs[j]
+	}, func(i, j int) {
+		pkgs[i], pkgs[j] = pkgs[j], pkgs[i]
+	})
+
+	foldedSet := make(villa.StrSet)
+	for _, pkg := range pkgs {
+		root := closestAncestor(pkg, func(root string) bool {
+			_, ok := byPkg[root]
+			return ok && !foldedSet.In(root)
+		})
+		if root != "" {
+			byPkg[root].subs = append(byPkg[root].subs, byPkg[pkg].row)
+			foldedSet.Put(pkg)
+		}
+	}
+
+	res := entries[:0]
+	for _, e := range entries {
+		if !foldedSet.In(e.row.Package) {
+			res = append(res, e)
+		}
+	}
+	return res, len(foldedSet), forks
+}
+
+// docLess returns true if doc a is ranked before doc b.
+func docLess(a, b *DocInfo) bool {
+	if a.Score != b.Score {
+		return a.Score > b.Score
+	}
+	if a.StarCount != b.StarCount {
+		return a.StarCount > b.StarCount
+	}
+	if len(a.Package) != len(b.Package) {
+		return len(a.Package) < len(b.Package)
+	}
+	return a.Package < b.Package
+}
+
+// fetchHits fetches the DocInfos of entries and scores them by m with the
+// StaticScores of their rows, which bound the scores. Entries whose documents
+// are gone are skipped. Documents in scored, by their packages, are not
+// fetched again, and those fetched are added to it if it is not nil.
+func fetchHits(c appengine.Context, entries []*hitEntry, groups []QueryGroup,
+		m *RankModel, scored map[string]*DocInfo) []*SearchHit {
+	var ids []string
+	var rows []*DocRow
+	for _, e := range entries {
+		if _, ok := scored[e.row.Package]; !ok {
+			ids = append(ids, e.row.Package)
+			rows = append(rows, e.row)
+		}
+	}
+	docs := make([]DocInfo, len(ids))
+	fetchDocs(c, ids, docs)
+	
+	if scored == nil {
+		scored = make(map[string]*DocInfo, len(ids))
+	}
+	for i := range docs {
+		d := &docs[i]
+		if d.Package == "" {
+			scored[ids[i]] = nil
+			continue
+		}
+		d.StaticScore = rows[i].StaticScore
+		m.scoreDoc(d, groups)
+		scored[ids[i]] = d
+	}
+
+	hits := make([]*SearchHit, 0, len(entries))
+	for _, e := range entries {
+		if d := scored[e.row.Package]; d != nil {
+			hits = append(hits, &SearchHit{
+				Doc:   d,
+				Subs:  e.subs,
+				Forks: e.forks,
+			})
+		}
+	}
+	return hits
+}
+
+// topHits returns the k best ranked entries by the scores of m. No unread
+// entry scores above tail. Documents scored are kept in scored.
+func topHits(c appengine.Context, entries []*hitEntry, groups []QueryGroup,
+		m *RankModel, k int, tail float64, scored map[string]*DocInfo) []*SearchHit {
+	// maxBounds[i] is the maximum bound of entries[i:] and unread ones
+	maxBounds := make([]float64, len(entries)+1)
+	maxBounds[len(entries)] = tail
+	for i := len(entries) - 1; i >= 0; i-- {
+		maxBounds[i] = math.Max(m.bound(entries[i].row, len(groups)),
+			maxBounds[i+1])
+	}
+	
+	batch := rankFetchBatch
+	if batch < k {
+		batch = k
+	}
+
+	var hits []*SearchHit
+	for i := 0; i < len(entries); i += batch {
+		if len(hits) >= k && hits[k-1].Doc.Score >= maxBounds[i] {
+			break
+		}
+
+		end := i + batch
+		if end > len(entries) {
+			end = len(entries)
+		}
+		hits = append(hits, fetchHits(c, entries[i:end], groups, m, scored)...)
+
+		villa.SortF(len(hits), func(i, j int) bool {
+			return docLess(hits[i].Doc, hits[j].Doc)
+		}, func(i, j int) {
+			hits[i], hits[j] = hits[j], hits[i]
+		})
+	}
+	c.Infof("%d of %d entries scored for top %d", len(scored), len(entries), k)
+
+	if len(hits) > k {
+		hits = hits[:k]
+	}
+	return hits
+}
+
+// sortedHits returns the first k entries in the order of opts.Sort.
+func sortedHits(c appengine.Context, entries []*hitEntry, groups []QueryGroup,
+		m *RankModel, opts SearchOptions, k int) []*SearchHit {
+	sortEntries(entries, opts.Sort)
+	if len(entries) > k {
+		entries = entries[:k]
+	}
+	return fetchHits(c, entries, groups, m, nil)
+}
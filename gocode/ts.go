@@ -5,6 +5,7 @@ import (
 	"appengine/datastore"
 	"github.com/daviddengcn/go-villa"
 	"log"
+	"time"
 )
 
 type TokenSet struct {
@@ -19,8 +20,57 @@ func NewTokenSet(c appengine.Context, typePrefix string) *TokenSet {
 	}
 }
 
+// IndexEntry is the index entry of a document. Besides the tokens, entries of
+// kindIndex keep a summary of the document, which projection queries read for
+// ranking, filtering and faceting without loading the DocInfos.
 type IndexEntry struct {
 	Tokens []string
+	
+	StaticScore   float64
+	Name          string
+	StarCount     int
+	ImportedCount int
+	LastUpdated   time.Time
+	License       string
+	ForkOf        string
+	Fingerprint   string
+	LastCommit    time.Time
+	Archived      bool
+	Deprecated    bool
+}
+
+// the projected properties of IndexEntry, see index.yaml. Entries without all
+// of them are not returned by projection queries, so indexVersion is increased
+// after adding one, and entries are read in full until /reindex has rewritten
+// them all.
+var indexSummaryFields = []string{
+	"StaticScore", "Name", "StarCount", "ImportedCount", "LastUpdated",
+	"License", "ForkOf", "Fingerprint", "LastCommit", "Archived", "Deprecated",
+}
+
+// the version of the summaries of index entries
+const indexVersion = 2
+
+const indexStateID = "state"
+
+// IndexState is the version of the summaries of all entries of kindIndex,
+// saved when reindexing is done.
+type IndexState struct {
+	Version int
+}
+
+func loadIndexVersion(c appengine.Context) int {
+	var state IndexState
+	if err, _ := NewCachedDocDB(c, kindIndexState).Get(indexStateID, &state); err != nil {
+		c.Errorf("Get(%s) failed: %v", kindIndexState, err)
+	}
+	return state.Version
+}
+
+func saveIndexVersion(c appengine.Context, version int) error {
+	return NewCachedDocDB(c, kindIndexState).Put(indexStateID, &IndexState{
+		Version: version,
+	})
 }
 
 func (ts *TokenSet) Clear(field string) error {
@@ -49,12 +99,16 @@ func (ts *TokenSet) Clear(field string) error {
 }
 
 func (ts *TokenSet) Index(field, id string, tokens villa.StrSet) error {
-	log.Printf("    [ts.Index] Adding %d tokens for field:%s id:%s",
-		len(tokens), field, id)
-	_, err := datastore.Put(ts.c, datastore.NewKey(ts.c, ts.typePrefix+field,
-		id, 0, nil), &IndexEntry{
+	return ts.Put(field, id, &IndexEntry{
 		Tokens: tokens.Elements(),
 	})
+}
+
+func (ts *TokenSet) Put(field, id string, ent *IndexEntry) error {
+	log.Printf("    [ts.Index] Adding %d tokens for field:%s id:%s",
+		len(ent.Tokens), field, id)
+	_, err := datastore.Put(ts.c, datastore.NewKey(ts.c, ts.typePrefix+field,
+		id, 0, nil), ent)
 	if err != nil {
 		return err
 	}
@@ -83,6 +137,118 @@ func (ts *TokenSet) Search(field string, tokens villa.StrSet) ([]string, error)
 	return res, nil
 }
 
+// EntryPager reads the ids and the summaries of the entries containing some
+// tokens in descending order of StaticScore, a page at a time. Until all
+// entries have the summaries of indexVersion, they are read in full in one
+// page, and those written before summaries were added have an empty Name.
+type EntryPager struct {
+	ts     *TokenSet
+	q      *datastore.Query
+	tokens villa.StrSet
+	// true if entries are read in full
+	full    bool
+	started bool
+	cursor  datastore.Cursor
+	done    bool
+}
+
+// PageEntries returns the pager of the entries containing all tokens.
+func (ts *TokenSet) PageEntries(field string, tokens villa.StrSet) *EntryPager {
+	q := datastore.NewQuery(ts.typePrefix + field)
+	for token := range tokens {
+		q = q.Filter("Tokens=", token)
+	}
+	return &EntryPager{
+		ts:     ts,
+		q:      q,
+		tokens: tokens,
+		full:   loadIndexVersion(ts.c) < indexVersion,
+	}
+}
+
+// Done returns true if all entries were read.
+func (p *EntryPager) Done() bool {
+	return p.done
+}
+
+// Next returns the next page of at most n entries.
+func (p *EntryPager) Next(n int) ([]string, []IndexEntry, error) {
+	if p.done {
+		return nil, nil, nil
+	}
+	if p.full {
+		p.done = true
+		return p.ts.searchFullEntries(p.q, p.tokens)
+	}
+	
+	q := p.q.Project(indexSummaryFields...).Order("-StaticScore").Limit(n)
+	if p.started {
+		q = q.Start(p.cursor)
+	}
+	var ids []string
+	var ents []IndexEntry
+	t := q.Run(p.ts.c)
+	for {
+		var ent IndexEntry
+		key, err := t.Next(&ent)
+		if err == datastore.Done {
+			break
+		}
+		if !DocGetOk(err) {
+			if !p.started && len(ids) == 0 {
+				// e.g. the index of the projection is still being built
+				p.ts.c.Errorf("Projecting entries of %v failed: %v", p.tokens, err)
+				p.full = true
+				return p.Next(n)
+			}
+			return nil, nil, err
+		}
+		// projected entries have no tokens
+		ent.Tokens = nil
+		ids = append(ids, key.StringID())
+		ents = append(ents, ent)
+	}
+	p.started = true
+	if len(ids) < n {
+		p.done = true
+	} else {
+		cursor, err := t.Cursor()
+		if err != nil {
+			return nil, nil, err
+		}
+		p.cursor = cursor
+	}
+	log.Printf("    [ts.PageEntries] %d entries for tokens %v", len(ids), p.tokens)
+	
+	return ids, ents, nil
+}
+
+// searchFullEntries returns all entries of q, read in full, in descending
+// order of StaticScore.
+func (ts *TokenSet) searchFullEntries(q *datastore.Query, tokens villa.StrSet) (
+		[]string, []IndexEntry, error) {
+	var ents []IndexEntry
+	keys, err := q.GetAll(ts.c, &ents)
+	if err != nil && !DocGetOk(err) {
+		return nil, nil, err
+	}
+	
+	ids := make([]string, len(keys))
+	for i, key := range keys {
+		ids[i] = key.StringID()
+		ents[i].Tokens = nil
+	}
+	villa.SortF(len(ids), func(i, j int) bool {
+		return ents[i].StaticScore > ents[j].StaticScore
+	}, func(i, j int) {
+		ids[i], ids[j] = ids[j], ids[i]
+		ents[i], ents[j] = ents[j], ents[i]
+	})
+	log.Printf("    [ts.searchFullEntries] %d entries for tokens %v", len(ids), tokens)
+	
+	return ids, ents, nil
+}
+
 func (ts *TokenSet) Count(field string, tokens villa.StrSet) (int, error) {
 	q := datastore.NewQuery(ts.typePrefix + field)
 	for token := range tokens {
@@ -0,0 +1,22 @@
+// Logs clicks on search results to /click for learning to rank.
+(function() {
+    var list = document.querySelector('ol.schres[data-imp]');
+    if (!list || !navigator.sendBeacon) {
+        return;
+    }
+    var imp = list.getAttribute('data-imp');
+    list.addEventListener('click', function(e) {
+        var a = e.target;
+        while (a && a != list && !a.hasAttribute('data-pos')) {
+            a = a.parentNode;
+        }
+        if (!a || a == list) {
+            return;
+        }
+        var data = new FormData();
+        data.append('imp', imp);
+        data.append('pos', a.getAttribute('data-pos'));
+        data.append('id', a.getAttribute('data-id'));
+        navigator.sendBeacon('/click', data);
+    }, true);
+})();
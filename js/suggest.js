@@ -0,0 +1,65 @@
+// Search-as-you-type completions of the query boxes, fetched from /suggest.
+(function() {
+    var DELAY = 100; // milliseconds after the last keystroke
+
+    function attach(box) {
+        var list = document.createElement('datalist');
+        list.id = 'suggest-' + Math.random().toString(36).substr(2);
+        box.parentNode.appendChild(list);
+        box.setAttribute('list', list.id);
+        box.setAttribute('autocomplete', 'off');
+
+        var timer = null, last = '', req = null;
+        function show(sugs) {
+            while (list.firstChild) {
+                list.removeChild(list.firstChild);
+            }
+            for (var i = 0; i < sugs.length; i++) {
+                var opt = document.createElement('option');
+                opt.value = sugs[i].Text;
+                if (sugs[i].Package && sugs[i].Package != sugs[i].Text) {
+                    opt.label = sugs[i].Package;
+                }
+                list.appendChild(opt);
+            }
+        }
+        function fetch() {
+            var q = box.value;
+            if (q == last) {
+                return;
+            }
+            last = q;
+            if (q.replace(/\s+/g, '').length < 2) {
+                show([]);
+                return;
+            }
+            if (req) {
+                req.abort();
+            }
+            req = new XMLHttpRequest();
+            req.onload = function() {
+                if (this.status == 200 && box.value == q) {
+                    show(JSON.parse(this.responseText).Suggestions || []);
+                }
+            };
+            req.open('GET', '/suggest?q=' + encodeURIComponent(q));
+            req.send();
+        }
+        box.addEventListener('input', function() {
+            clearTimeout(timer);
+            timer = setTimeout(fetch, DELAY);
+        });
+    }
+
+    function init() {
+        var boxes = document.querySelectorAll('input.query-box');
+        for (var i = 0; i < boxes.length; i++) {
+            attach(boxes[i]);
+        }
+    }
+    if (document.readyState == 'loading') {
+        document.addEventListener('DOMContentLoaded', init);
+    } else {
+        init();
+    }
+})();